@@ -9,13 +9,13 @@ package main
 import (
 	_ "embed"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/jmoiron/sqlx"
 	"github.com/julienschmidt/httprouter"
 	"github.com/trilobio/ar3"
 	"io/ioutil"
 	"log"
-	"math"
 	_ "modernc.org/sqlite"
 	"net/http"
 	"os"
@@ -41,6 +41,10 @@ func main() {
 	if err != nil {
 		log.Fatalf("Failed to connect to database with error: %s", err)
 	}
+	if dbUrl == ":memory:" {
+		// Every new connection to ":memory:" opens a new, empty database.
+		db.SetMaxOpenConns(1)
+	}
 	_ = CreateDatabase(db)
 	app := initializeApp(db)
 
@@ -59,6 +63,8 @@ type App struct {
 	DB      *sqlx.DB
 	ArmMock ar3.Arm
 	Arm     ar3.Arm
+	Pipette Pipette
+	Runner  *Runner
 }
 
 // initalizeApp initializes an App for all endpoints to use.
@@ -67,16 +73,18 @@ func initializeApp(db *sqlx.DB) App {
 	app.Router = httprouter.New()
 	app.DB = db
 	app.Arm = ar3.ConnectMock()
-	err := app.Arm.MoveJointRadians(25, 10, 10, 10, 10, 0, 0, math.Pi/4, 0, -math.Pi/4, 0, 0)
+	err := readyArm(app.Arm)
 	if err != nil {
 		fmt.Println("damn")
 		log.Fatalf("Failed to move arm with failure %s", err)
 	}
 	app.ArmMock = ar3.ConnectMock()
-	err = app.ArmMock.MoveJointRadians(25, 10, 10, 10, 10, 0, 0, math.Pi/4, 0, -math.Pi/4, 0, 0)
+	err = readyArm(app.ArmMock)
 	if err != nil {
 		log.Fatalf("Failed to move mock arm with failure %s", err)
 	}
+	app.Pipette = ConnectMockPipette(300)
+	app.Runner = NewRunner(db, app.Arm, app.Pipette)
 
 	// Basic routes
 	app.Router.GET("/api/ping", app.Ping)
@@ -86,7 +94,14 @@ func initializeApp(db *sqlx.DB) App {
 	// Labwares
 	app.Router.GET("/api/labwares", rootHandler(app.ApiGetLabwares).ServeHTTP)
 	app.Router.GET("/api/labwares/:name", rootHandler(app.ApiGetLabware).ServeHTTP)
+	app.Router.GET("/api/labwares/:name/export", rootHandler(app.ApiExportLabware).ServeHTTP)
+	app.Router.GET("/api/labwares/:name/versions", rootHandler(app.ApiGetLabwareVersions).ServeHTTP)
+	app.Router.PUT("/api/labwares/:name/default", rootHandler(app.ApiSetDefaultLabware).ServeHTTP)
 	app.Router.POST("/api/labwares", rootHandler(app.ApiPostLabware).ServeHTTP)
+	app.Router.POST("/api/labwares/import", rootHandler(app.ApiImportLabware).ServeHTTP)
+	app.Router.POST("/api/labwares/generate", rootHandler(app.ApiGenerateLabware).ServeHTTP)
+	app.Router.PUT("/api/labwares/:name", rootHandler(app.ApiPutLabware).ServeHTTP)
+	app.Router.PATCH("/api/labwares/:name", rootHandler(app.ApiPatchLabware).ServeHTTP)
 	app.Router.DELETE("/api/labwares/:name", rootHandler(app.ApiDeleteLabware).ServeHTTP)
 
 	// Decks
@@ -98,6 +113,34 @@ func initializeApp(db *sqlx.DB) App {
 
 	// Protocol
 	app.Router.POST("/api/protocols", rootHandler(app.ApiProtocol).ServeHTTP)
+	app.Router.POST("/api/protocols/simulate", rootHandler(app.ApiSimulateProtocol).ServeHTTP)
+	app.Router.POST("/api/protocols/estimate", rootHandler(app.ApiEstimateProtocol).ServeHTTP)
+
+	// Generators
+	app.Router.POST("/api/generators/serial-dilution", rootHandler(app.ApiSerialDilution).ServeHTTP)
+	app.Router.POST("/api/generators/cherry-pick", rootHandler(app.ApiCherryPick).ServeHTTP)
+
+	// Runs
+	app.Router.GET("/api/runs", rootHandler(app.ApiGetRuns).ServeHTTP)
+	app.Router.GET("/api/runs/:id", rootHandler(app.ApiGetRun).ServeHTTP)
+	app.Router.GET("/api/runs/:id/events", rootHandler(app.ApiRunEvents).ServeHTTP)
+	app.Router.POST("/api/runs/:id/pause", rootHandler(app.ApiPauseRun).ServeHTTP)
+	app.Router.POST("/api/runs/:id/resume", rootHandler(app.ApiResumeRun).ServeHTTP)
+	app.Router.POST("/api/runs/:id/cancel", rootHandler(app.ApiCancelRun).ServeHTTP)
+
+	// Emergency stop
+	app.Router.GET("/api/estop", rootHandler(app.ApiGetEStop).ServeHTTP)
+	app.Router.POST("/api/estop", rootHandler(app.ApiEStop).ServeHTTP)
+	app.Router.POST("/api/estop/reset", rootHandler(app.ApiResetEStop).ServeHTTP)
+
+	// Tip racks
+	app.Router.GET("/api/tipracks/:deck/:location", rootHandler(app.ApiGetTipRack).ServeHTTP)
+	app.Router.POST("/api/tipracks/:deck/:location/reset", rootHandler(app.ApiResetTipRack).ServeHTTP)
+	app.Router.POST("/api/tipracks/:deck/:location/refill", rootHandler(app.ApiRefillTipRack).ServeHTTP)
+
+	// Lock
+	app.Router.GET("/api/lock", rootHandler(app.ApiGetLock).ServeHTTP)
+	app.Router.DELETE("/api/lock", rootHandler(app.ApiReleaseLock).ServeHTTP)
 
 	return app
 }
@@ -113,7 +156,13 @@ func (fn rootHandler) ServeHTTP(w http.ResponseWriter, r *http.Request, p httpro
 	err := fn(w, r, p)
 	if err != nil {
 		log.Printf("ERROR: %s", err) // Log the error
-		w.WriteHeader(400)
+		// Errors may carry their own status code, otherwise it is a bad request
+		status := 400
+		var statusErr interface{ StatusCode() int }
+		if errors.As(err, &statusErr) {
+			status = statusErr.StatusCode()
+		}
+		w.WriteHeader(status)
 		_, err = w.Write([]byte(err.Error()))
 		if err != nil {
 			log.Printf("An error occurred while writing error: %v", err)
@@ -219,11 +268,13 @@ func (app *App) ApiGetLabwares(w http.ResponseWriter, r *http.Request, _ httprou
 
 }
 
-// ApiGetLabware is a route for getting a single labware.
+// ApiGetLabware is a route for getting a single labware, by default its
+// default version.
 // @Summary Get one labware
 // @Tags labware
 // @Produce json
 // @Param name path string true "Labware name"
+// @Param version query int false "Labware version"
 // @Success 200 {object} Labware
 // @Failure 400 {string} string
 // @Router /labwares/{name} [get]
@@ -233,8 +284,9 @@ func (app *App) ApiGetLabware(w http.ResponseWriter, r *http.Request, ps httprou
 		return err
 	}
 
-	labware, err := GetLabware(tx, ps.ByName("name"))
+	labware, err := requestedLabware(tx, ps.ByName("name"), r)
 	if err != nil {
+		_ = tx.Rollback()
 		return err
 	}
 
@@ -251,6 +303,138 @@ func (app *App) ApiGetLabware(w http.ResponseWriter, r *http.Request, ps httprou
 
 }
 
+// ApiExportLabware is a route to export a labware as an Opentrons labware
+// schema v2 definition, which can be loaded on an Opentrons robot.
+// @Summary Export one labware
+// @Tags labware
+// @Produce json
+// @Param name path string true "Labware name"
+// @Param version query int false "Labware version"
+// @Param format query string false "Export format" Enums(opentrons)
+// @Success 200 {object} OpentronsLabware
+// @Failure 400 {string} string
+// @Router /labwares/{name}/export [get]
+func (app *App) ApiExportLabware(w http.ResponseWriter, r *http.Request, ps httprouter.Params) error {
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "opentrons" {
+		return fmt.Errorf("Unsupported export format: %s", format)
+	}
+
+	tx, err := app.DB.Beginx()
+	if err != nil {
+		return err
+	}
+
+	labware, err := requestedLabware(tx, ps.ByName("name"), r)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	err = tx.Rollback()
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", labware.Name+".json"))
+	err = json.NewEncoder(w).Encode(LabwareToOpentrons(labware))
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// requestedLabware gets the version of a labware given by the version query
+// parameter, or its default version.
+func requestedLabware(tx *sqlx.Tx, name string, r *http.Request) (Labware, error) {
+	version := r.URL.Query().Get("version")
+	if version == "" {
+		return GetLabware(tx, name)
+	}
+	number, err := strconv.Atoi(version)
+	if err != nil {
+		return Labware{}, fmt.Errorf("Invalid version: %s", version)
+	}
+	return GetLabwareVersion(tx, name, number)
+}
+
+// ApiGetLabwareVersions is a route for getting every version of a labware.
+// @Summary Get the versions of one labware
+// @Tags labware
+// @Produce json
+// @Param name path string true "Labware name"
+// @Success 200 {object} []Labware
+// @Failure 400 {string} string
+// @Router /labwares/{name}/versions [get]
+func (app *App) ApiGetLabwareVersions(w http.ResponseWriter, r *http.Request, ps httprouter.Params) error {
+	tx, err := app.DB.Beginx()
+	if err != nil {
+		return err
+	}
+
+	labwares, err := GetLabwareVersions(tx, ps.ByName("name"))
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	err = tx.Rollback()
+	if err != nil {
+		return err
+	}
+
+	err = json.NewEncoder(w).Encode(labwares)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// DefaultLabware is the version of a labware to use when none is pinned.
+type DefaultLabware struct {
+	Version int `json:"version"`
+}
+
+// ApiSetDefaultLabware is a route to set the default version of a labware.
+// @Summary Set the default version of one labware
+// @Tags labware
+// @Accept json
+// @Produce json
+// @Param name path string true "Labware name"
+// @Param default body DefaultLabware true "Default version"
+// @Success 200 {object} Message
+// @Failure 400 {string} string
+// @Router /labwares/{name}/default [put]
+func (app *App) ApiSetDefaultLabware(w http.ResponseWriter, r *http.Request, ps httprouter.Params) error {
+	var defaultLabware DefaultLabware
+	err := json.NewDecoder(r.Body).Decode(&defaultLabware)
+	if err != nil {
+		return err
+	}
+
+	tx, err := app.DB.Beginx()
+	if err != nil {
+		return err
+	}
+
+	err = SetDefaultLabwareVersion(tx, ps.ByName("name"), defaultLabware.Version)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	err = json.NewEncoder(w).Encode(Message{"successful"})
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
 // ApiPostLabware is a route to create a labware.
 // @Summary Create one labware
 // @Tags labware
@@ -261,39 +445,251 @@ func (app *App) ApiGetLabware(w http.ResponseWriter, r *http.Request, ps httprou
 // @Failure 400 {string} string
 // @Router /labwares/ [post]
 func (app *App) ApiPostLabware(w http.ResponseWriter, r *http.Request, _ httprouter.Params) error {
+	var labware Labware
+	reqBody, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(reqBody, &labware)
+	if err != nil {
+		return err
+	}
+
 	tx, err := app.DB.Beginx()
 	if err != nil {
 		return err
 	}
 
-	var labware Labware
+	err = CreateLabware(tx, labware)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	err = json.NewEncoder(w).Encode(Message{"successful"})
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// ImportedLabwares lists the names of imported labwares.
+type ImportedLabwares struct {
+	Imported []string `json:"imported"`
+}
+
+// ApiImportLabware is a route to import Opentrons labware definitions, such
+// as those made with the Opentrons Labware Creator. The body is either a
+// single JSON definition or a zip of JSON definitions, which are imported
+// together or not at all.
+// @Summary Import Opentrons labware definitions
+// @Tags labware
+// @Accept json,application/zip
+// @Produce json
+// @Param definition body OpentronsLabware true "Opentrons labware definition, or a zip of them"
+// @Success 200 {object} ImportedLabwares
+// @Failure 400 {string} string
+// @Router /labwares/import [post]
+func (app *App) ApiImportLabware(w http.ResponseWriter, r *http.Request, _ httprouter.Params) error {
 	reqBody, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		return err
 	}
-	err = json.Unmarshal(reqBody, &labware)
+	labwares, err := ReadOpentronsLabwares(reqBody)
 	if err != nil {
 		return err
 	}
 
-	err = CreateLabware(tx, labware)
+	tx, err := app.DB.Beginx()
 	if err != nil {
 		return err
 	}
 
+	imported := ImportedLabwares{Imported: []string{}}
+	for _, labware := range labwares {
+		err = CreateLabware(tx, labware)
+		if err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("%s: %s", labware.Name, err)
+		}
+		imported.Imported = append(imported.Imported, labware.Name)
+	}
+
 	err = tx.Commit()
 	if err != nil {
 		return err
 	}
 
-	err = json.NewEncoder(w).Encode(Message{"successful"})
+	err = json.NewEncoder(w).Encode(imported)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// ApiGenerateLabware is a route to generate a custom labware with wells on a
+// grid. The labware is stored, or only returned if preview is true.
+// @Summary Generate a labware from a grid
+// @Tags labware
+// @Accept json
+// @Produce json
+// @Param grid body LabwareGrid true "Labware grid"
+// @Param preview query bool false "Return the labware without storing it"
+// @Success 200 {object} Labware
+// @Failure 400 {string} string
+// @Router /labwares/generate [post]
+func (app *App) ApiGenerateLabware(w http.ResponseWriter, r *http.Request, _ httprouter.Params) error {
+	var grid LabwareGrid
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&grid)
+	if err != nil {
+		return err
+	}
+
+	labware, err := GenerateLabware(grid)
+	if err != nil {
+		return err
+	}
+
+	if r.URL.Query().Get("preview") != "true" {
+		tx, err := app.DB.Beginx()
+		if err != nil {
+			return err
+		}
+		err = CreateLabware(tx, labware)
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+	}
+
+	err = json.NewEncoder(w).Encode(labware)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// ApiPutLabware is a route to replace a labware, including all of its wells.
+// The version in the body is updated, or else the default version.
+// @Summary Replace one labware
+// @Tags labware
+// @Accept json
+// @Produce json
+// @Param name path string true "Labware name"
+// @Param labware body Labware true "Labware"
+// @Param force query bool false "Update the labware even if it is in use"
+// @Success 200 {object} Labware
+// @Failure 400 {string} string
+// @Failure 409 {string} string
+// @Router /labwares/{name} [put]
+func (app *App) ApiPutLabware(w http.ResponseWriter, r *http.Request, ps httprouter.Params) error {
+	var labware Labware
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&labware)
+	if err != nil {
+		return err
+	}
+	if labware.Name != "" && labware.Name != ps.ByName("name") {
+		return fmt.Errorf("The name of a labware can not be changed")
+	}
+
+	tx, err := app.DB.Beginx()
+	if err != nil {
+		return err
+	}
+
+	labware.Name = ps.ByName("name")
+	if labware.Version == 0 {
+		current, err := GetLabware(tx, labware.Name)
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+		labware.Version = current.Version
+	}
+	return app.updatedLabware(w, r, tx, labware)
+}
+
+// ApiPatchLabware is a route to change some fields of a labware, such as the
+// depth of a single well. Wells are changed by their address, and only the
+// fields given are changed. The version query parameter selects the version
+// to change, or else the default version.
+// @Summary Change one labware
+// @Tags labware
+// @Accept json
+// @Produce json
+// @Param name path string true "Labware name"
+// @Param version query int false "Labware version"
+// @Param patch body Labware true "Fields of the labware to change"
+// @Param force query bool false "Update the labware even if it is in use"
+// @Success 200 {object} Labware
+// @Failure 400 {string} string
+// @Failure 409 {string} string
+// @Router /labwares/{name} [patch]
+func (app *App) ApiPatchLabware(w http.ResponseWriter, r *http.Request, ps httprouter.Params) error {
+	patch, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+
+	tx, err := app.DB.Beginx()
+	if err != nil {
+		return err
+	}
+
+	labware, err := requestedLabware(tx, ps.ByName("name"), r)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	labware, err = PatchLabware(labware, patch)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return app.updatedLabware(w, r, tx, labware)
+}
+
+// updatedLabware stores an updated labware, honoring the force query
+// parameter, then commits and writes the labware.
+func (app *App) updatedLabware(w http.ResponseWriter, r *http.Request, tx *sqlx.Tx, labware Labware) error {
+	err := UpdateLabware(tx, labware, r.URL.Query().Get("force") == "true")
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	labware, err = GetLabwareVersion(tx, labware.Name, labware.Version)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	err = json.NewEncoder(w).Encode(labware)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-// ApiDeleteLabware is a route to delete a labware.
+// ApiDeleteLabware is a route to delete every version of a labware.
 // @Summary Delete one labware
 // @Tags labware
 // @Produce json
@@ -541,43 +937,713 @@ func (app *App) ApiDeleteDeck(w http.ResponseWriter, r *http.Request, ps httprou
 
 ******************************************************************************/
 
-// ApiProtocol runs a protocol
+// ApiProtocol starts a run of a protocol. The protocol runs in the
+// background; poll /runs/{id} for its status.
 // @Summary Run a protocol
 // @Tags protocol
 // @Accept json
 // @Produce json
 // @Param collection body []CommandInput true "commandInput"
-// @Success 200 {string} string
+// @Param optimize query bool false "Optimize the path of the arm, defaults to true"
+// @Param reorder query bool false "Reorder independent tip cycles, defaults to false"
+// @Success 200 {object} Run
 // @Failure 400 {string} string
-// @Router /protocol [post]
+// @Router /protocols [post]
 func (app *App) ApiProtocol(w http.ResponseWriter, r *http.Request, _ httprouter.Params) error {
-	var commands []interface{}
 	reqBody, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		return err
 	}
-	err = json.Unmarshal(reqBody, &commands)
+	commandInputs, err := DecodeProtocol(reqBody)
 	if err != nil {
-		fmt.Println("ah")
 		return err
 	}
+	return app.submitProtocol(w, r, commandInputs)
+}
 
-	var commandInputs []CommandInput
-	for _, command := range commands {
-		var newCommand CommandInput
-		var ok bool
-		newCommand, ok = command.(CommandXyz)
-		if ok {
-			commandInputs = append(commandInputs, newCommand)
-		}
+// submitProtocol starts a run of a protocol and writes the new Run.
+func (app *App) submitProtocol(w http.ResponseWriter, r *http.Request, protocol []CommandInput) error {
+	id, err := app.Runner.Start(protocol, optimizeOptions(r))
+	if err != nil {
+		return err
+	}
 
-		newCommand, ok = command.(CommandMove)
-		if ok {
-			commandInputs = append(commandInputs, newCommand)
-		}
+	tx, err := app.DB.Beginx()
+	if err != nil {
+		return err
+	}
+
+	run, err := GetRun(tx, id)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	err = tx.Rollback()
+	if err != nil {
+		return err
+	}
+
+	err = json.NewEncoder(w).Encode(run)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// optimizeOptions reads the optimize and reorder query parameters of a
+// protocol request. Optimization is on and reordering off unless requested.
+func optimizeOptions(r *http.Request) OptimizeOptions {
+	options := DefaultOptimizeOptions
+	query := r.URL.Query()
+	if query.Get("optimize") != "" {
+		options.Optimize = query.Get("optimize") == "true"
 	}
+	if query.Get("reorder") != "" {
+		options.Reorder = query.Get("reorder") == "true"
+	}
+	return options
+}
 
-	err = ExecuteProtocol(app.DB, app.Arm, commandInputs)
+// ApiSimulateProtocol compiles a protocol without touching the arm, returning
+// every pose and wait the arm would execute in order.
+// @Summary Simulate a protocol
+// @Tags protocol
+// @Accept json
+// @Produce json
+// @Param collection body []CommandInput true "commandInput"
+// @Param optimize query bool false "Optimize the path of the arm, defaults to true"
+// @Param reorder query bool false "Reorder independent tip cycles, defaults to false"
+// @Success 200 {object} []Command
+// @Failure 400 {string} string
+// @Router /protocols/simulate [post]
+func (app *App) ApiSimulateProtocol(w http.ResponseWriter, r *http.Request, _ httprouter.Params) error {
+	reqBody, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	commandInputs, err := DecodeProtocol(reqBody)
+	if err != nil {
+		return err
+	}
+
+	commands, err := SimulateProtocol(app.DB, app.Pipette, commandInputs, optimizeOptions(r))
+	if err != nil {
+		return err
+	}
+
+	err = json.NewEncoder(w).Encode(commands)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// ApiEstimateProtocol estimates how long a protocol takes to run from the
+// arm's ready position, in total and for each step.
+// @Summary Estimate the duration of a protocol
+// @Tags protocol
+// @Accept json
+// @Produce json
+// @Param collection body []CommandInput true "commandInput"
+// @Param optimize query bool false "Optimize the path of the arm, defaults to true"
+// @Param reorder query bool false "Reorder independent tip cycles, defaults to false"
+// @Success 200 {object} Estimate
+// @Failure 400 {string} string
+// @Router /protocols/estimate [post]
+func (app *App) ApiEstimateProtocol(w http.ResponseWriter, r *http.Request, _ httprouter.Params) error {
+	reqBody, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	commandInputs, err := DecodeProtocol(reqBody)
+	if err != nil {
+		return err
+	}
+
+	commands, err := SimulateProtocol(app.DB, app.Pipette, commandInputs, optimizeOptions(r))
+	if err != nil {
+		return err
+	}
+
+	err = json.NewEncoder(w).Encode(EstimateProtocol(commands, readyPose()))
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+/******************************************************************************
+
+                                Generators
+
+******************************************************************************/
+
+// ApiSerialDilution is a route to generate a serial dilution protocol. The
+// protocol is returned for preview, or started as a run if submit is true.
+// @Summary Generate a serial dilution protocol
+// @Tags generator
+// @Accept json
+// @Produce json
+// @Param dilution body SerialDilution true "Serial dilution"
+// @Param submit query bool false "Start a run of the protocol"
+// @Param optimize query bool false "Optimize the path of the arm, defaults to true"
+// @Param reorder query bool false "Reorder independent tip cycles, defaults to false"
+// @Success 200 {object} []CommandInput
+// @Failure 400 {string} string
+// @Router /generators/serial-dilution [post]
+func (app *App) ApiSerialDilution(w http.ResponseWriter, r *http.Request, _ httprouter.Params) error {
+	var dilution SerialDilution
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&dilution)
+	if err != nil {
+		return err
+	}
+
+	protocol, err := GenerateSerialDilution(dilution, app.Pipette)
+	if err != nil {
+		return err
+	}
+	return app.generatedProtocol(w, r, protocol)
+}
+
+// ApiCherryPick is a route to generate a cherry picking protocol from a CSV
+// of transfers. Invalid rows of the CSV are all reported at once. The
+// protocol is returned for preview, or started as a run if submit is true.
+// @Summary Generate a cherry picking protocol from a CSV
+// @Tags generator
+// @Accept json
+// @Produce json
+// @Param pick body CherryPick true "Cherry pick"
+// @Param submit query bool false "Start a run of the protocol"
+// @Param optimize query bool false "Optimize the path of the arm, defaults to true"
+// @Param reorder query bool false "Reorder independent tip cycles, defaults to false"
+// @Success 200 {object} []CommandInput
+// @Failure 400 {string} string
+// @Router /generators/cherry-pick [post]
+func (app *App) ApiCherryPick(w http.ResponseWriter, r *http.Request, _ httprouter.Params) error {
+	var pick CherryPick
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&pick)
+	if err != nil {
+		return err
+	}
+
+	tx, err := app.DB.Beginx()
+	if err != nil {
+		return err
+	}
+
+	protocol, err := GenerateCherryPick(tx, pick)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	err = tx.Rollback()
+	if err != nil {
+		return err
+	}
+	return app.generatedProtocol(w, r, protocol)
+}
+
+// generatedProtocol starts a run of a generated protocol if the submit query
+// parameter is true, otherwise it checks that the protocol compiles and
+// writes it for preview.
+func (app *App) generatedProtocol(w http.ResponseWriter, r *http.Request, protocol []CommandInput) error {
+	if r.URL.Query().Get("submit") == "true" {
+		return app.submitProtocol(w, r, protocol)
+	}
+
+	_, err := SimulateProtocol(app.DB, app.Pipette, protocol, optimizeOptions(r))
+	if err != nil {
+		return err
+	}
+	encoded, err := EncodeProtocol(protocol)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(encoded)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+/******************************************************************************
+
+                                Runs
+
+******************************************************************************/
+
+// ApiGetRuns is a route for getting all runs.
+// @Summary Get all runs
+// @Tags run
+// @Produce json
+// @Success 200 {object} []Run
+// @Failure 400 {string} string
+// @Router /runs [get]
+func (app *App) ApiGetRuns(w http.ResponseWriter, r *http.Request, _ httprouter.Params) error {
+	tx, err := app.DB.Beginx()
+	if err != nil {
+		return err
+	}
+
+	runs, err := GetRuns(tx)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	err = tx.Rollback()
+	if err != nil {
+		return err
+	}
+
+	err = json.NewEncoder(w).Encode(runs)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// ApiGetRun is a route for getting a single run.
+// @Summary Get one run
+// @Tags run
+// @Produce json
+// @Param id path int true "Run ID"
+// @Success 200 {object} Run
+// @Failure 400 {string} string
+// @Router /runs/{id} [get]
+func (app *App) ApiGetRun(w http.ResponseWriter, r *http.Request, ps httprouter.Params) error {
+	id, err := strconv.ParseInt(ps.ByName("id"), 10, 64)
+	if err != nil {
+		return err
+	}
+
+	tx, err := app.DB.Beginx()
+	if err != nil {
+		return err
+	}
+
+	run, err := GetRun(tx, id)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	err = tx.Rollback()
+	if err != nil {
+		return err
+	}
+
+	err = json.NewEncoder(w).Encode(run)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// ApiRunEvents is a route that streams the events of a run as Server-Sent
+// Events until the run ends. Clients reconnecting with a Last-Event-ID header
+// are first sent every event they missed.
+// @Summary Stream the events of a run
+// @Tags run
+// @Produce text/event-stream
+// @Param id path int true "Run ID"
+// @Param Last-Event-ID header int false "ID of the last event received"
+// @Success 200 {object} RunEvent
+// @Failure 400 {string} string
+// @Router /runs/{id}/events [get]
+func (app *App) ApiRunEvents(w http.ResponseWriter, r *http.Request, ps httprouter.Params) error {
+	id, err := strconv.ParseInt(ps.ByName("id"), 10, 64)
+	if err != nil {
+		return err
+	}
+	var lastEventID int64
+	if header := r.Header.Get("Last-Event-ID"); header != "" {
+		lastEventID, err = strconv.ParseInt(header, 10, 64)
+		if err != nil {
+			return fmt.Errorf("Invalid Last-Event-ID: %s", err)
+		}
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return fmt.Errorf("Streaming is not supported")
+	}
+
+	streaming := false
+	for {
+		// Subscribe before reading, so no event is missed in between
+		events := app.Runner.Events()
+
+		tx, err := app.DB.Beginx()
+		if err != nil {
+			return err
+		}
+		run, err := GetRun(tx, id)
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+		newEvents, err := GetRunEvents(tx, id, lastEventID)
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+		err = tx.Rollback()
+		if err != nil {
+			return err
+		}
+
+		if !streaming {
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Header().Set("Cache-Control", "no-cache")
+			streaming = true
+		}
+		for _, event := range newEvents {
+			data, err := json.Marshal(event)
+			if err != nil {
+				return err
+			}
+			_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+			if err != nil {
+				// The client has gone away
+				return nil
+			}
+			lastEventID = event.ID
+		}
+		flusher.Flush()
+
+		// The run was read before its events, so every event has been sent
+		if run.End != nil {
+			return nil
+		}
+		select {
+		case <-events:
+		case <-r.Context().Done():
+			return nil
+		}
+	}
+}
+
+// ApiPauseRun is a route to pause a run. The run pauses once the arm finishes
+// its current command.
+// @Summary Pause a run
+// @Tags run
+// @Produce json
+// @Param id path int true "Run ID"
+// @Success 200 {string} string
+// @Failure 400 {string} string
+// @Router /runs/{id}/pause [post]
+func (app *App) ApiPauseRun(w http.ResponseWriter, r *http.Request, ps httprouter.Params) error {
+	id, err := strconv.ParseInt(ps.ByName("id"), 10, 64)
+	if err != nil {
+		return err
+	}
+
+	err = app.Runner.Pause(id)
+	if err != nil {
+		return err
+	}
+
+	err = json.NewEncoder(w).Encode(Message{"successful"})
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// ApiResumeRun is a route to resume a paused run from where it stopped.
+// @Summary Resume a run
+// @Tags run
+// @Produce json
+// @Param id path int true "Run ID"
+// @Success 200 {string} string
+// @Failure 400 {string} string
+// @Router /runs/{id}/resume [post]
+func (app *App) ApiResumeRun(w http.ResponseWriter, r *http.Request, ps httprouter.Params) error {
+	id, err := strconv.ParseInt(ps.ByName("id"), 10, 64)
+	if err != nil {
+		return err
+	}
+
+	err = app.Runner.Resume(id)
+	if err != nil {
+		return err
+	}
+
+	err = json.NewEncoder(w).Encode(Message{"successful"})
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// ApiCancelRun is a route to cancel a run. The run stops once the arm
+// finishes its current command.
+// @Summary Cancel a run
+// @Tags run
+// @Produce json
+// @Param id path int true "Run ID"
+// @Success 200 {string} string
+// @Failure 400 {string} string
+// @Router /runs/{id}/cancel [post]
+func (app *App) ApiCancelRun(w http.ResponseWriter, r *http.Request, ps httprouter.Params) error {
+	id, err := strconv.ParseInt(ps.ByName("id"), 10, 64)
+	if err != nil {
+		return err
+	}
+
+	err = app.Runner.Cancel(id)
+	if err != nil {
+		return err
+	}
+
+	err = json.NewEncoder(w).Encode(Message{"successful"})
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+/******************************************************************************
+
+                                Tip racks
+
+******************************************************************************/
+
+// ApiGetTipRack is a route for getting the tips used from the tip rack at a
+// location of a deck.
+// @Summary Get the tip inventory of a tip rack
+// @Tags tiprack
+// @Produce json
+// @Param deck path string true "Deck name"
+// @Param location path string true "Location name"
+// @Success 200 {object} TipRack
+// @Failure 400 {string} string
+// @Router /tipracks/{deck}/{location} [get]
+func (app *App) ApiGetTipRack(w http.ResponseWriter, r *http.Request, ps httprouter.Params) error {
+	tx, err := app.DB.Beginx()
+	if err != nil {
+		return err
+	}
+
+	tipRack, err := GetTipRack(tx, ps.ByName("deck"), ps.ByName("location"))
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	err = tx.Rollback()
+	if err != nil {
+		return err
+	}
+
+	err = json.NewEncoder(w).Encode(tipRack)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// ApiResetTipRack is a route to mark every tip of a tip rack as available,
+// such as after placing a new rack.
+// @Summary Reset a tip rack
+// @Tags tiprack
+// @Produce json
+// @Param deck path string true "Deck name"
+// @Param location path string true "Location name"
+// @Success 200 {string} string
+// @Failure 400 {string} string
+// @Router /tipracks/{deck}/{location}/reset [post]
+func (app *App) ApiResetTipRack(w http.ResponseWriter, r *http.Request, ps httprouter.Params) error {
+	tx, err := app.DB.Beginx()
+	if err != nil {
+		return err
+	}
+
+	err = ResetTipRack(tx, ps.ByName("deck"), ps.ByName("location"))
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	err = json.NewEncoder(w).Encode(Message{"successful"})
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// ApiRefillTipRack is a route to mark some tips of a tip rack as available,
+// such as after partially refilling it.
+// @Summary Refill tips of a tip rack
+// @Tags tiprack
+// @Accept json
+// @Produce json
+// @Param deck path string true "Deck name"
+// @Param location path string true "Location name"
+// @Param refill body TipRackRefill true "Refilled tips"
+// @Success 200 {string} string
+// @Failure 400 {string} string
+// @Router /tipracks/{deck}/{location}/refill [post]
+func (app *App) ApiRefillTipRack(w http.ResponseWriter, r *http.Request, ps httprouter.Params) error {
+	var refill TipRackRefill
+	err := json.NewDecoder(r.Body).Decode(&refill)
+	if err != nil {
+		return err
+	}
+
+	tx, err := app.DB.Beginx()
+	if err != nil {
+		return err
+	}
+
+	err = RefillTipRack(tx, ps.ByName("deck"), ps.ByName("location"), refill.Addresses)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	err = json.NewEncoder(w).Encode(Message{"successful"})
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+/******************************************************************************
+
+                                Lock
+
+******************************************************************************/
+
+// ApiGetLock is a route for getting the device lock.
+// @Summary Get the device lock
+// @Tags lock
+// @Produce json
+// @Success 200 {object} Lock
+// @Failure 400 {string} string
+// @Router /lock [get]
+func (app *App) ApiGetLock(w http.ResponseWriter, r *http.Request, _ httprouter.Params) error {
+	tx, err := app.DB.Beginx()
+	if err != nil {
+		return err
+	}
+
+	lock, err := GetLock(tx)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	err = tx.Rollback()
+	if err != nil {
+		return err
+	}
+
+	err = json.NewEncoder(w).Encode(lock)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// ApiReleaseLock is a route to force release a stale device lock, such as
+// one left behind by a crash. The holding run is marked as FAILED. A run
+// that is still executing must be cancelled instead.
+// @Summary Force release the device lock
+// @Tags lock
+// @Produce json
+// @Success 200 {string} string
+// @Failure 400 {string} string
+// @Failure 409 {string} string
+// @Router /lock [delete]
+func (app *App) ApiReleaseLock(w http.ResponseWriter, r *http.Request, _ httprouter.Params) error {
+	err := app.Runner.ForceReleaseLock()
+	if err != nil {
+		return err
+	}
+
+	err = json.NewEncoder(w).Encode(Message{"successful"})
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+/******************************************************************************
+
+                                Emergency stop
+
+******************************************************************************/
+
+// EStop is the state of the emergency stop.
+type EStop struct {
+	Latched bool `json:"latched"`
+}
+
+// ApiGetEStop is a route for getting the state of the emergency stop.
+// @Summary Get the emergency stop
+// @Tags estop
+// @Produce json
+// @Success 200 {object} EStop
+// @Router /estop [get]
+func (app *App) ApiGetEStop(w http.ResponseWriter, r *http.Request, _ httprouter.Params) error {
+	err := json.NewEncoder(w).Encode(EStop{app.Runner.EStopped()})
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// ApiEStop is a route to press the emergency stop. The current run is marked
+// as FAILED and all motion is refused until the emergency stop is reset. This
+// is a soft stop: the move in progress is finished before the arm stops, so
+// it does not replace a hardware emergency stop.
+// @Summary Press the emergency stop
+// @Description Soft stop: the arm stops once its current move finishes.
+// @Tags estop
+// @Produce json
+// @Success 200 {string} string
+// @Failure 400 {string} string
+// @Router /estop [post]
+func (app *App) ApiEStop(w http.ResponseWriter, r *http.Request, _ httprouter.Params) error {
+	err := app.Runner.EStop()
+	if err != nil {
+		return err
+	}
+
+	err = json.NewEncoder(w).Encode(Message{"successful"})
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// ApiResetEStop is a route to reset the emergency stop. The arm is re-homed
+// before motion is allowed again.
+// @Summary Reset the emergency stop
+// @Tags estop
+// @Produce json
+// @Success 200 {string} string
+// @Failure 400 {string} string
+// @Router /estop/reset [post]
+func (app *App) ApiResetEStop(w http.ResponseWriter, r *http.Request, _ httprouter.Params) error {
+	err := app.Runner.ResetEStop()
 	if err != nil {
 		return err
 	}
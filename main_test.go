@@ -1,16 +1,22 @@
 package main
 
 import (
+	"archive/zip"
 	"bytes"
 	"encoding/json"
 	"fmt"
 	"github.com/jmoiron/sqlx"
+	"github.com/trilobio/ar3"
+	"github.com/trilobio/kinematics"
 	"io/ioutil"
 	"log"
 	"net/http/httptest"
 	"os"
+	"reflect"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 )
 
 var app App
@@ -22,6 +28,8 @@ func TestMain(m *testing.M) {
 	if err != nil {
 		log.Fatalf("Failed to open SQLite in main test function. Got error: %s", err)
 	}
+	// Every new connection to ":memory:" opens a new, empty database.
+	db.SetMaxOpenConns(1)
 	err = CreateDatabase(db)
 	if err != nil {
 		log.Fatalf("Failed to create database. Got err: %s", err)
@@ -35,6 +43,10 @@ func TestMain(m *testing.M) {
 	if err != nil {
 		log.Fatalf("Failed to CreateDeck: %s", err)
 	}
+	err = SetDeckCalibration(tx, "deck", 257, 0, 307, 0, 0.7071067811865476, 0, -0.7071067811865476)
+	if err != nil {
+		log.Fatalf("Failed to SetDeckCalibration: %s", err)
+	}
 	err = tx.Commit()
 	if err != nil {
 		log.Fatalf("Failed to commit: %s", err)
@@ -57,7 +69,7 @@ func TestPing(t *testing.T) {
 
 func TestLabwareApi(t *testing.T) {
 	// Create a new labware
-	m, _ := json.Marshal(Labware{"apiPlate", 10, []Well{Well{Address: "A1", Depth: 1, Diameter: 1, X: 1, Y: 1, Z: 1}}})
+	m, _ := json.Marshal(Labware{Name: "apiPlate", ZDimension: 10, Wells: []Well{Well{Address: "A1", Depth: 1, Diameter: 1, X: 1, Y: 1, Z: 1}}})
 	req := httptest.NewRequest("POST", "/api/labwares", bytes.NewReader(m))
 	resp := httptest.NewRecorder()
 	app.Router.ServeHTTP(resp, req)
@@ -110,6 +122,15 @@ func TestLabwareApi(t *testing.T) {
 		}
 	}
 
+	// Invalid labware is rejected with every violation
+	m, _ = json.Marshal(Labware{Name: "badPlate", ZDimension: 10, Wells: []Well{Well{Address: "A1", Depth: -1, Diameter: 1}, Well{Address: "A1", Depth: 1, Diameter: 1}}})
+	req = httptest.NewRequest("POST", "/api/labwares", bytes.NewReader(m))
+	resp = httptest.NewRecorder()
+	app.Router.ServeHTTP(resp, req)
+	if resp.Code != 400 || !strings.Contains(resp.Body.String(), "Labware has 2 violations") {
+		t.Errorf("Invalid labware should fail with 400. Got: %d %s", resp.Code, resp.Body.String())
+	}
+
 	// Delete apiPlate labware
 	req = httptest.NewRequest("DELETE", "/api/labwares/apiPlate", nil)
 	resp = httptest.NewRecorder()
@@ -119,9 +140,305 @@ func TestLabwareApi(t *testing.T) {
 	}
 }
 
+func TestImportLabwareApi(t *testing.T) {
+	definition, err := content.ReadFile("data/opentrons_96_tiprack_300ul/1.json")
+	if err != nil {
+		t.Fatalf("Failed to read definition. Got error: %s", err)
+	}
+	custom := func(name string) []byte {
+		return bytes.Replace(definition, []byte(`"loadName": "opentrons_96_tiprack_300ul"`), []byte(`"loadName": "`+name+`"`), 1)
+	}
+	defer func() {
+		tx := db.MustBegin()
+		for _, name := range []string{"custom_tiprack", "zipped_tiprack_1", "zipped_tiprack_2"} {
+			_ = DeleteLabware(tx, name)
+		}
+		_ = tx.Commit()
+	}()
+
+	// Import a single definition
+	req := httptest.NewRequest("POST", "/api/labwares/import", bytes.NewReader(custom("custom_tiprack")))
+	resp := httptest.NewRecorder()
+	app.Router.ServeHTTP(resp, req)
+	if strings.TrimSpace(resp.Body.String()) != `{"imported":["custom_tiprack"]}` {
+		t.Fatalf("Import should succeed. Got: %d %s", resp.Code, resp.Body.String())
+	}
+	tx := db.MustBegin()
+	labware, err := GetLabware(tx, "custom_tiprack")
+	_ = tx.Rollback()
+	if err != nil || !labware.IsTiprack || len(labware.Wells) != 96 {
+		t.Errorf("Imported tip rack should be stored. Got: %v %+v", err, labware)
+	}
+
+	// Import a zip of definitions
+	var archive bytes.Buffer
+	writer := zip.NewWriter(&archive)
+	for _, name := range []string{"zipped_tiprack_1", "zipped_tiprack_2"} {
+		file, _ := writer.Create(name + ".json")
+		_, _ = file.Write(custom(name))
+	}
+	_ = writer.Close()
+	req = httptest.NewRequest("POST", "/api/labwares/import", bytes.NewReader(archive.Bytes()))
+	resp = httptest.NewRecorder()
+	app.Router.ServeHTTP(resp, req)
+	if strings.TrimSpace(resp.Body.String()) != `{"imported":["zipped_tiprack_1","zipped_tiprack_2"]}` {
+		t.Errorf("Zip import should succeed. Got: %d %s", resp.Code, resp.Body.String())
+	}
+
+	// Invalid definitions are rejected
+	for _, bad := range [][]byte{
+		bytes.Replace(custom("bad_tiprack"), []byte(`"schemaVersion": 2`), []byte(`"schemaVersion": 1`), 1),
+		bytes.Replace(custom("bad_tiprack"), []byte(`"shape": "circular"`), []byte(`"shape": "hexagonal"`), 1),
+		custom("custom_tiprack"),
+	} {
+		req = httptest.NewRequest("POST", "/api/labwares/import", bytes.NewReader(bad))
+		resp = httptest.NewRecorder()
+		app.Router.ServeHTTP(resp, req)
+		if resp.Code != 400 {
+			t.Errorf("Invalid definition should fail with 400. Got: %d %s", resp.Code, resp.Body.String())
+		}
+	}
+}
+
+func TestExportLabwareApi(t *testing.T) {
+	req := httptest.NewRequest("GET", "/api/labwares/agilent_1_reservoir_290ml/export?format=opentrons", nil)
+	resp := httptest.NewRecorder()
+	app.Router.ServeHTTP(resp, req)
+	if resp.Code != 200 {
+		t.Fatalf("Export should succeed. Got: %d %s", resp.Code, resp.Body.String())
+	}
+	var ol OpentronsLabware
+	err := json.Unmarshal(resp.Body.Bytes(), &ol)
+	if err != nil {
+		t.Fatalf("Failed to decode export. Got error: %s", err)
+	}
+	if ol.SchemaVersion != 2 || ol.Parameters.LoadName != "agilent_1_reservoir_290ml" || ol.Wells["A1"].XDimension != 108 {
+		t.Errorf("Export should be an Opentrons definition. Got: %+v", ol)
+	}
+
+	// The export imports back under a new name
+	ol.Parameters.LoadName = "exported_reservoir"
+	definition, _ := json.Marshal(ol)
+	req = httptest.NewRequest("POST", "/api/labwares/import", bytes.NewReader(definition))
+	resp = httptest.NewRecorder()
+	app.Router.ServeHTTP(resp, req)
+	if resp.Code != 200 {
+		t.Errorf("Exported definition should import. Got: %d %s", resp.Code, resp.Body.String())
+	}
+	tx := db.MustBegin()
+	_ = DeleteLabware(tx, "exported_reservoir")
+	_ = tx.Commit()
+
+	req = httptest.NewRequest("GET", "/api/labwares/agilent_1_reservoir_290ml/export?format=csv", nil)
+	resp = httptest.NewRecorder()
+	app.Router.ServeHTTP(resp, req)
+	if resp.Code != 400 {
+		t.Errorf("Unsupported format should fail with 400. Got: %d", resp.Code)
+	}
+}
+
+func TestLabwareVersionsApi(t *testing.T) {
+	definition, err := content.ReadFile("data/nest_96_wellplate_100ul_pcr_full_skirt/1.json")
+	if err != nil {
+		t.Fatalf("Failed to read definition. Got error: %s", err)
+	}
+	definition = bytes.Replace(definition, []byte(`"loadName": "nest_96_wellplate_100ul_pcr_full_skirt"`), []byte(`"loadName": "versioned_plate"`), 1)
+	defer func() {
+		tx := db.MustBegin()
+		_ = DeleteLabware(tx, "versioned_plate")
+		_ = tx.Commit()
+	}()
+	for _, version := range []string{"1", "2"} {
+		versioned := bytes.Replace(definition, []byte(`"version": 1,`), []byte(`"version": `+version+`,`), 1)
+		req := httptest.NewRequest("POST", "/api/labwares/import", bytes.NewReader(versioned))
+		resp := httptest.NewRecorder()
+		app.Router.ServeHTTP(resp, req)
+		if resp.Code != 200 {
+			t.Fatalf("Import of version %s should succeed. Got: %d %s", version, resp.Code, resp.Body.String())
+		}
+	}
+
+	getVersion := func(url string) int {
+		req := httptest.NewRequest("GET", url, nil)
+		resp := httptest.NewRecorder()
+		app.Router.ServeHTTP(resp, req)
+		var labware Labware
+		_ = json.Unmarshal(resp.Body.Bytes(), &labware)
+		return labware.Version
+	}
+	if version := getVersion("/api/labwares/versioned_plate"); version != 2 {
+		t.Errorf("Latest version should be the default. Got: %d", version)
+	}
+	if version := getVersion("/api/labwares/versioned_plate?version=1"); version != 1 {
+		t.Errorf("Version 1 should be gotten. Got: %d", version)
+	}
+
+	req := httptest.NewRequest("GET", "/api/labwares/versioned_plate/versions", nil)
+	resp := httptest.NewRecorder()
+	app.Router.ServeHTTP(resp, req)
+	var versions []Labware
+	_ = json.Unmarshal(resp.Body.Bytes(), &versions)
+	if len(versions) != 2 {
+		t.Errorf("Both versions should be listed. Got: %s", resp.Body.String())
+	}
+
+	req = httptest.NewRequest("PUT", "/api/labwares/versioned_plate/default", strings.NewReader(`{"version": 1}`))
+	resp = httptest.NewRecorder()
+	app.Router.ServeHTTP(resp, req)
+	if resp.Code != 200 {
+		t.Errorf("Setting the default version should succeed. Got: %d %s", resp.Code, resp.Body.String())
+	}
+	if version := getVersion("/api/labwares/versioned_plate"); version != 1 {
+		t.Errorf("Default version should be 1. Got: %d", version)
+	}
+	req = httptest.NewRequest("PUT", "/api/labwares/versioned_plate/default", strings.NewReader(`{"version": 3}`))
+	resp = httptest.NewRecorder()
+	app.Router.ServeHTTP(resp, req)
+	if resp.Code != 400 {
+		t.Errorf("Setting a missing default version should fail with 400. Got: %d", resp.Code)
+	}
+
+	// The run records the versions it used
+	protocol, _ := EncodeProtocol([]CommandInput{
+		CommandMove{Deck: "deck", Location: "1", LabwareName: "versioned_plate", Address: "A1", DepthFromBottom: 1},
+		CommandMove{Deck: "deck", Location: "1", LabwareName: "versioned_plate", LabwareVersion: 2, Address: "B1", DepthFromBottom: 1},
+	})
+	req = httptest.NewRequest("POST", "/api/protocols", bytes.NewReader(protocol))
+	resp = httptest.NewRecorder()
+	app.Router.ServeHTTP(resp, req)
+	var run Run
+	err = json.Unmarshal(resp.Body.Bytes(), &run)
+	if err != nil {
+		t.Fatalf("Unmarshal of run should succeed. Got error: %s, body: %s", err, resp.Body.String())
+	}
+	run = waitForRun(t, run.ID)
+	expected := LabwareVersions{{Name: "versioned_plate", Version: 1}, {Name: "versioned_plate", Version: 2}}
+	if run.Status != RunCompleted || !reflect.DeepEqual(run.Labwares, expected) {
+		t.Errorf("Run should record the labware versions it used. Got: %s %v", run.Status, run.Labwares)
+	}
+}
+
+func TestGenerateLabwareApi(t *testing.T) {
+	grid := `{"name": "printed_rack", "rows": 2, "columns": 3, "row_pitch": 30, "column_pitch": 30, "a1_x": 30, "a1_y": 60, "z_offset": 2, "well_shape": "rectangular", "well_x_dimension": 20, "well_y_dimension": 20, "well_depth": 30, "x_dimension": 127.76, "y_dimension": 85.48, "z_dimension": 40}`
+	defer func() {
+		tx := db.MustBegin()
+		_ = DeleteLabware(tx, "printed_rack")
+		_ = tx.Commit()
+	}()
+	exists := func() bool {
+		tx := db.MustBegin()
+		_, err := GetLabware(tx, "printed_rack")
+		_ = tx.Rollback()
+		return err == nil
+	}
+
+	// Preview without storing
+	req := httptest.NewRequest("POST", "/api/labwares/generate?preview=true", strings.NewReader(grid))
+	resp := httptest.NewRecorder()
+	app.Router.ServeHTTP(resp, req)
+	var labware Labware
+	err := json.Unmarshal(resp.Body.Bytes(), &labware)
+	if err != nil {
+		t.Fatalf("Unmarshal of labware should succeed. Got error: %s, body: %s", err, resp.Body.String())
+	}
+	if len(labware.Wells) != 6 || labware.Wells[5].Address != "B3" || labware.Wells[5].XDimension != 20 {
+		t.Errorf("Preview should have 6 rectangular wells. Got: %+v", labware.Wells)
+	}
+	if exists() {
+		t.Errorf("Preview should not store the labware")
+	}
+
+	// Generate and store
+	req = httptest.NewRequest("POST", "/api/labwares/generate", strings.NewReader(grid))
+	resp = httptest.NewRecorder()
+	app.Router.ServeHTTP(resp, req)
+	if resp.Code != 200 || !exists() {
+		t.Errorf("Generated labware should be stored. Got: %d %s", resp.Code, resp.Body.String())
+	}
+	req = httptest.NewRequest("POST", "/api/labwares/generate", strings.NewReader(grid))
+	resp = httptest.NewRecorder()
+	app.Router.ServeHTTP(resp, req)
+	if resp.Code != 400 {
+		t.Errorf("Generating an existing labware should fail with 400. Got: %d", resp.Code)
+	}
+}
+
+func TestUpdateLabwareApi(t *testing.T) {
+	grid := `{"name": "api_update_rack", "rows": 1, "columns": 2, "column_pitch": 30, "a1_x": 30, "a1_y": 40, "well_diameter": 10, "well_depth": 30, "x_dimension": 127.76, "y_dimension": 85.48, "z_dimension": 40}`
+	req := httptest.NewRequest("POST", "/api/labwares/generate", strings.NewReader(grid))
+	resp := httptest.NewRecorder()
+	app.Router.ServeHTTP(resp, req)
+	if resp.Code != 200 {
+		t.Fatalf("Failed to generate labware. Got: %d %s", resp.Code, resp.Body.String())
+	}
+	var labware Labware
+	_ = json.Unmarshal(resp.Body.Bytes(), &labware)
+	defer func() {
+		tx := db.MustBegin()
+		_ = ResetTipRack(tx, "deck", "1")
+		_ = DeleteLabware(tx, "api_update_rack")
+		_ = tx.Commit()
+	}()
+
+	// Patch a single well
+	req = httptest.NewRequest("PATCH", "/api/labwares/api_update_rack", strings.NewReader(`{"wells": [{"address": "A2", "depth": 29}]}`))
+	resp = httptest.NewRecorder()
+	app.Router.ServeHTTP(resp, req)
+	var patched Labware
+	_ = json.Unmarshal(resp.Body.Bytes(), &patched)
+	if resp.Code != 200 || patched.Wells[1].Depth != 29 || patched.Wells[0].Depth != 30 {
+		t.Errorf("Patch should change the depth of A2. Got: %d %s", resp.Code, resp.Body.String())
+	}
+
+	// Replace the whole labware
+	labware.ZDimension = 45
+	body, _ := json.Marshal(labware)
+	req = httptest.NewRequest("PUT", "/api/labwares/api_update_rack", bytes.NewReader(body))
+	resp = httptest.NewRecorder()
+	app.Router.ServeHTTP(resp, req)
+	var replaced Labware
+	_ = json.Unmarshal(resp.Body.Bytes(), &replaced)
+	if resp.Code != 200 || replaced.ZDimension != 45 || replaced.Wells[1].Depth != 30 {
+		t.Errorf("Put should replace the labware. Got: %d %s", resp.Code, resp.Body.String())
+	}
+	req = httptest.NewRequest("PUT", "/api/labwares/other_name", bytes.NewReader(body))
+	resp = httptest.NewRecorder()
+	app.Router.ServeHTTP(resp, req)
+	if resp.Code != 400 {
+		t.Errorf("Put should not rename the labware. Got: %d", resp.Code)
+	}
+
+	// Misspelled fields are rejected rather than ignored
+	for method, misspelled := range map[string]string{"PATCH": `{"wells": [{"address": "A1", "depht": 5}]}`, "PUT": `{"zDimensoin": 45}`} {
+		req = httptest.NewRequest(method, "/api/labwares/api_update_rack", strings.NewReader(misspelled))
+		resp = httptest.NewRecorder()
+		app.Router.ServeHTTP(resp, req)
+		if resp.Code != 400 || !strings.Contains(resp.Body.String(), "unknown field") {
+			t.Errorf("%s with a misspelled field should fail. Got: %d %s", method, resp.Code, resp.Body.String())
+		}
+	}
+
+	// Labware placed as a tip rack is in use
+	tx := db.MustBegin()
+	_ = UseTip(tx, Tip{Placement: Placement{Deck: "deck", Location: "1", LabwareName: "api_update_rack"}, Address: "A1"})
+	_ = tx.Commit()
+	req = httptest.NewRequest("PATCH", "/api/labwares/api_update_rack", strings.NewReader(`{"wells": [{"address": "A1", "depth": 29}]}`))
+	resp = httptest.NewRecorder()
+	app.Router.ServeHTTP(resp, req)
+	if resp.Code != 409 {
+		t.Errorf("Patch of labware in use should fail with 409. Got: %d %s", resp.Code, resp.Body.String())
+	}
+	req = httptest.NewRequest("PATCH", "/api/labwares/api_update_rack?force=true", strings.NewReader(`{"wells": [{"address": "A1", "depth": 29}]}`))
+	resp = httptest.NewRecorder()
+	app.Router.ServeHTTP(resp, req)
+	if resp.Code != 200 {
+		t.Errorf("Forced patch should succeed. Got: %d %s", resp.Code, resp.Body.String())
+	}
+}
+
 func TestDeckApi(t *testing.T) {
 	// Create a new deck
-	m, _ := json.Marshal(InputDeck{"defaultDeck", []Location{Location{Name: "1", X: 1, Y: 1, Z: 1}}})
+	m, _ := json.Marshal(InputDeck{Name: "defaultDeck", Locations: []Location{Location{Name: "1", X: 1, Y: 1, Z: 1}}})
 	req := httptest.NewRequest("POST", "/api/decks", bytes.NewReader(m))
 	resp := httptest.NewRecorder()
 	app.Router.ServeHTTP(resp, req)
@@ -196,18 +513,813 @@ func TestDeckApi(t *testing.T) {
 func TestProtocolApi(t *testing.T) {
 	// Create a new deck
 	var moves []CommandInput
-	moves = append(moves, CommandXyz{132, 158, 121, 0.8063737663657652, -0.575080903948282, -0.13494466363153904, 0.02886590702694046})
-	moves = append(moves, CommandXyz{132, 158, 141, 0.8063737663657652, -0.575080903948282, -0.13494466363153904, 0.02886590702694046}) // Move up by 20
+	moves = append(moves, CommandXyz{257, 0, 287, 0, 0.7071067811865476, 0, -0.7071067811865476})
+	moves = append(moves, CommandXyz{257, 0, 307, 0, 0.7071067811865476, 0, -0.7071067811865476}) // Move up by 20
 	moves = append(moves, CommandMove{Deck: "deck", Location: "1", LabwareName: "nest_96_wellplate_100ul_pcr_full_skirt", Address: "A1", DepthFromBottom: 1})
 	moves = append(moves, CommandMove{Deck: "deck", Location: "1", LabwareName: "nest_96_wellplate_100ul_pcr_full_skirt", Address: "B1", DepthFromBottom: 1})
 
-	m, _ := json.Marshal(moves)
+	m, err := EncodeProtocol(moves)
+	if err != nil {
+		t.Errorf("EncodeProtocol should succeed. Got error: %s", err)
+	}
 	req := httptest.NewRequest("POST", "/api/protocols", bytes.NewReader(m))
 	resp := httptest.NewRecorder()
 	app.Router.ServeHTTP(resp, req)
 
+	var run Run
+	err = json.Unmarshal(resp.Body.Bytes(), &run)
+	if err != nil {
+		t.Fatalf("Unmarshal of run should succeed. Got error: %s, body: %s", err, resp.Body.String())
+	}
+	if run.Status != RunRunning && run.Status != RunCompleted {
+		t.Errorf("New run should be RUNNING. Got: %s", run.Status)
+	}
+
+	// Poll the run until it finishes
+	run = waitForRun(t, run.ID)
+	if run.Status != RunCompleted {
+		t.Errorf("Run should have COMPLETED. Got: %s", run.Status)
+	}
+	if run.End == nil {
+		t.Errorf("Completed run should have an end time")
+	}
+	if run.EstimatedDuration == nil || *run.EstimatedDuration <= 0 {
+		t.Errorf("Run should have an estimated duration")
+	}
+
+	// Get runs
+	req = httptest.NewRequest("GET", "/api/runs", nil)
+	resp = httptest.NewRecorder()
+	app.Router.ServeHTTP(resp, req)
+	var runs []Run
+	err = json.Unmarshal(resp.Body.Bytes(), &runs)
+	if err != nil {
+		t.Errorf("Unmarshal of runs should succeed. Got error: %s", err)
+	}
+	if len(runs) == 0 || runs[len(runs)-1].ID != run.ID {
+		t.Errorf("Runs should end with run %d. Got: %v", run.ID, runs)
+	}
+
+	// Protocols that leave the workspace are rejected before they start
+	unreachable, _ := EncodeProtocol([]CommandInput{CommandXyz{257, 0, 287, 0, 0.7071067811865476, 0, -0.7071067811865476}, CommandXyz{132, 158, 121, 0, 0.7071067811865476, 0, -0.7071067811865476}})
+	req = httptest.NewRequest("POST", "/api/protocols", bytes.NewReader(unreachable))
+	resp = httptest.NewRecorder()
+	app.Router.ServeHTTP(resp, req)
+	if resp.Code != 400 || !strings.Contains(resp.Body.String(), "step 1, command 1") {
+		t.Errorf("Unreachable protocol should fail naming step 1. Got: %d %s", resp.Code, resp.Body.String())
+	}
+
+	// Unknown fields should be rejected with the index of the bad step
+	badProtocol := `[{"command": "movexyz", "x": 257, "y": 0, "z": 307}, {"command": "move", "labware": "plate"}]`
+	req = httptest.NewRequest("POST", "/api/protocols", strings.NewReader(badProtocol))
+	resp = httptest.NewRecorder()
+	app.Router.ServeHTTP(resp, req)
+	if resp.Code != 400 {
+		t.Errorf("Protocol with unknown field should fail with 400. Got: %d", resp.Code)
+	}
+	if !strings.HasPrefix(resp.Body.String(), "step 1:") {
+		t.Errorf("Error should name step 1. Got: %s", resp.Body.String())
+	}
+}
+
+func TestSimulateProtocolApi(t *testing.T) {
+	var moves []CommandInput
+	moves = append(moves, CommandXyz{257, 0, 287, 0, 0.7071067811865476, 0, -0.7071067811865476})
+	moves = append(moves, CommandMove{Deck: "deck", Location: "1", LabwareName: "nest_96_wellplate_100ul_pcr_full_skirt", Address: "A1", DepthFromBottom: 1})
+	m, _ := EncodeProtocol(moves)
+
+	before := app.Arm.CurrentJointRadians()
+	req := httptest.NewRequest("POST", "/api/protocols/simulate", bytes.NewReader(m))
+	resp := httptest.NewRecorder()
+	app.Router.ServeHTTP(resp, req)
+	if app.Arm.CurrentJointRadians() != before {
+		t.Errorf("Simulating should not move the arm")
+	}
+
+	var commands []Command
+	err := json.Unmarshal(resp.Body.Bytes(), &commands)
+	if err != nil {
+		t.Fatalf("Unmarshal of commands should succeed. Got error: %s, body: %s", err, resp.Body.String())
+	}
+	if len(commands) != 4 {
+		t.Fatalf("Should have compiled 4 commands. Got: %d", len(commands))
+	}
+	// deck (257, 0, 307) + location (1, 1, 1) + well A1 (14.38, 74.24, 0.92)
+	bottom := commands[2]
+	if bottom.Step != 1 || bottom.Pose.Position.X != 272.38 || bottom.Pose.Position.Y != 75.24 || bottom.Pose.Position.Z != 309.92 {
+		t.Errorf("Third command should move into A1 at depth 1. Got: %+v", bottom)
+	}
+
+	// Optimization can be turned off per request
+	plate := Placement{Deck: "deck", Location: "1", LabwareName: "nest_96_wellplate_100ul_pcr_full_skirt"}
+	tipRack := Placement{Deck: "deck", Location: "1", LabwareName: "opentrons_96_tiprack_300ul"}
+	m, _ = EncodeProtocol([]CommandInput{CommandPickUpTip{Placement: tipRack}, CommandMove{Deck: "deck", Location: "1", LabwareName: plate.LabwareName, Address: "A1"}, CommandMix{Placement: plate, Address: "A1", Volume: 10, Repetitions: 1}})
+	for query, expected := range map[string]int{"": 9, "?optimize=false": 12} {
+		req = httptest.NewRequest("POST", "/api/protocols/simulate"+query, bytes.NewReader(m))
+		resp = httptest.NewRecorder()
+		app.Router.ServeHTTP(resp, req)
+		commands = nil
+		err = json.Unmarshal(resp.Body.Bytes(), &commands)
+		if err != nil || len(commands) != expected {
+			t.Errorf("Simulating with %q should compile %d commands. Got: %s", query, expected, resp.Body.String())
+		}
+	}
+}
+
+func TestEstimateProtocolApi(t *testing.T) {
+	moves := []CommandInput{CommandMove{Deck: "deck", Location: "1", LabwareName: "nest_96_wellplate_100ul_pcr_full_skirt", Address: "A1", DepthFromBottom: 1}}
+	m, _ := EncodeProtocol(moves)
+	req := httptest.NewRequest("POST", "/api/protocols/estimate", bytes.NewReader(m))
+	resp := httptest.NewRecorder()
+	app.Router.ServeHTTP(resp, req)
+
+	var estimate Estimate
+	err := json.Unmarshal(resp.Body.Bytes(), &estimate)
+	if err != nil {
+		t.Fatalf("Unmarshal of estimate should succeed. Got error: %s, body: %s", err, resp.Body.String())
+	}
+	if len(estimate.Steps) != 1 || estimate.Steps[0].Duration != estimate.Duration || estimate.Duration <= 0 {
+		t.Errorf("Estimate should have one step taking the whole duration. Got: %+v", estimate)
+	}
+}
+
+func TestTipRackApi(t *testing.T) {
+	tipRack := Placement{Deck: "deck", Location: "1", LabwareName: "opentrons_96_tiprack_300ul"}
+	getTipRack := func() TipRack {
+		req := httptest.NewRequest("GET", "/api/tipracks/deck/1", nil)
+		resp := httptest.NewRecorder()
+		app.Router.ServeHTTP(resp, req)
+		var rack TipRack
+		err := json.Unmarshal(resp.Body.Bytes(), &rack)
+		if err != nil {
+			t.Fatalf("Unmarshal of tip rack should succeed. Got error: %s, body: %s", err, resp.Body.String())
+		}
+		return rack
+	}
+
+	// Run a protocol using the next available tips
+	protocol, _ := EncodeProtocol([]CommandInput{
+		CommandPickUpTip{Placement: tipRack},
+		CommandDropTip{Placement: tipRack, Address: "H12"},
+		CommandPickUpTip{Placement: tipRack},
+		CommandDropTip{Placement: tipRack, Address: "H12"},
+	})
+	req := httptest.NewRequest("POST", "/api/protocols", bytes.NewReader(protocol))
+	resp := httptest.NewRecorder()
+	app.Router.ServeHTTP(resp, req)
+	var run Run
+	err := json.Unmarshal(resp.Body.Bytes(), &run)
+	if err != nil {
+		t.Fatalf("Unmarshal of run should succeed. Got error: %s, body: %s", err, resp.Body.String())
+	}
+	run = waitForRun(t, run.ID)
+	if run.Status != RunCompleted {
+		t.Fatalf("Run should have COMPLETED. Got: %s %v", run.Status, run.StatusMessage)
+	}
+	rack := getTipRack()
+	if len(rack.Used) != 2 || rack.Used[0] != "A1" || rack.Used[1] != "B1" {
+		t.Errorf("Tips A1 and B1 should be used. Got: %v", rack.Used)
+	}
+
+	// The next protocol continues from the next tip, and cannot reuse tips
+	commands, err := SimulateProtocol(db, ConnectMockPipette(300), []CommandInput{CommandPickUpTip{Placement: tipRack}}, OptimizeOptions{})
+	if err != nil {
+		t.Fatalf("Failed to SimulateProtocol. Got error: %s", err)
+	}
+	if commands[2].Tip == nil || commands[2].Tip.Address != "C1" {
+		t.Errorf("Next tip should be C1. Got: %+v", commands[2])
+	}
+	_, err = SimulateProtocol(db, ConnectMockPipette(300), []CommandInput{CommandPickUpTip{Placement: tipRack, Address: "A1"}}, OptimizeOptions{})
+	if err == nil {
+		t.Errorf("Used tip A1 should not be picked up")
+	}
+
+	// Refill A1
+	req = httptest.NewRequest("POST", "/api/tipracks/deck/1/refill", strings.NewReader(`{"addresses": ["A1"]}`))
+	resp = httptest.NewRecorder()
+	app.Router.ServeHTTP(resp, req)
+	if resp.Code != 200 {
+		t.Errorf("Refill should succeed. Got: %d %s", resp.Code, resp.Body.String())
+	}
+	rack = getTipRack()
+	if len(rack.Used) != 1 || rack.Used[0] != "B1" {
+		t.Errorf("Only tip B1 should be used. Got: %v", rack.Used)
+	}
+
+	// Reset the rack
+	req = httptest.NewRequest("POST", "/api/tipracks/deck/1/reset", nil)
+	resp = httptest.NewRecorder()
+	app.Router.ServeHTTP(resp, req)
+	if resp.Code != 200 {
+		t.Errorf("Reset should succeed. Got: %d %s", resp.Code, resp.Body.String())
+	}
+	rack = getTipRack()
+	if len(rack.Used) != 0 {
+		t.Errorf("No tips should be used. Got: %v", rack.Used)
+	}
+}
+
+func TestSerialDilutionApi(t *testing.T) {
+	plate := Placement{Deck: "deck", Location: "1", LabwareName: "nest_96_wellplate_100ul_pcr_full_skirt"}
+	tipRack := Placement{Deck: "deck", Location: "1", LabwareName: "opentrons_96_tiprack_300ul"}
+	dilution, _ := json.Marshal(SerialDilution{Plate: plate, StartColumn: 1, Steps: 3, DilutionFactor: 3, FinalVolume: 50, Diluent: plate, DiluentWell: "H12", TipRack: tipRack, Trash: tipRack})
+	defer func() {
+		tx := db.MustBegin()
+		_ = ResetTipRack(tx, "deck", "1")
+		_ = tx.Commit()
+	}()
+
+	// Preview
+	req := httptest.NewRequest("POST", "/api/generators/serial-dilution", bytes.NewReader(dilution))
+	resp := httptest.NewRecorder()
+	app.Router.ServeHTTP(resp, req)
+	protocol, err := DecodeProtocol(resp.Body.Bytes())
+	if err != nil {
+		t.Fatalf("Preview should be a protocol. Got error: %s, body: %s", err, resp.Body.String())
+	}
+	if len(protocol) != 17 {
+		t.Errorf("Serial dilution of 3 steps should have 17 commands. Got %d", len(protocol))
+	}
+	distribute := protocol[0].(CommandDistribute)
+	if strings.Join(distribute.DestinationWells, ",") != "A2,A3,A4" || distribute.Volumes[0] != 50 {
+		t.Errorf("Diluent should be distributed to A2:A4. Got: %+v", distribute)
+	}
+	aspirate := protocol[2].(CommandAspirate)
+	if aspirate.Address != "A1" || aspirate.Volume != 25 {
+		t.Errorf("First transfer should take 25µL from A1. Got: %+v", aspirate)
+	}
+
+	// Submit
+	req = httptest.NewRequest("POST", "/api/generators/serial-dilution?submit=true", bytes.NewReader(dilution))
+	resp = httptest.NewRecorder()
+	app.Router.ServeHTTP(resp, req)
+	var run Run
+	err = json.Unmarshal(resp.Body.Bytes(), &run)
+	if err != nil {
+		t.Fatalf("Unmarshal of run should succeed. Got error: %s, body: %s", err, resp.Body.String())
+	}
+	run = waitForRun(t, run.ID)
+	if run.Status != RunCompleted {
+		t.Errorf("Run should have COMPLETED. Got: %s %v", run.Status, run.StatusMessage)
+	}
+
+	// Bad dilutions are rejected
+	req = httptest.NewRequest("POST", "/api/generators/serial-dilution", strings.NewReader(`{"steps": 3, "dilution_factor": 1}`))
+	resp = httptest.NewRecorder()
+	app.Router.ServeHTTP(resp, req)
+	if resp.Code != 400 {
+		t.Errorf("Bad dilution should fail with 400. Got: %d", resp.Code)
+	}
+}
+
+func TestCherryPickApi(t *testing.T) {
+	plate := Placement{Deck: "deck", Location: "1", LabwareName: "nest_96_wellplate_100ul_pcr_full_skirt"}
+	tipRack := Placement{Deck: "deck", Location: "1", LabwareName: "opentrons_96_tiprack_300ul"}
+	pick := CherryPick{
+		CSV:     "Source,From,Dest,To,uL\nsrc,C1,dst,A12,10\nsrc,A1,dst,B12,20\n",
+		Columns: CherryPickColumns{SourcePlate: "Source", SourceWell: "From", DestinationPlate: "Dest", DestinationWell: "To", Volume: "uL"},
+		Plates:  map[string]Placement{"src": plate, "dst": plate},
+		TipRack: tipRack,
+		Trash:   tipRack,
+	}
+	body, _ := json.Marshal(pick)
+	req := httptest.NewRequest("POST", "/api/generators/cherry-pick", bytes.NewReader(body))
+	resp := httptest.NewRecorder()
+	app.Router.ServeHTTP(resp, req)
+	protocol, err := DecodeProtocol(resp.Body.Bytes())
+	if err != nil {
+		t.Fatalf("Preview should be a protocol. Got error: %s, body: %s", err, resp.Body.String())
+	}
+	if len(protocol) != 1 {
+		t.Fatalf("Rows between the same plates should be one transfer. Got %d steps", len(protocol))
+	}
+	transfer := protocol[0].(CommandTransfer)
+	if strings.Join(transfer.SourceWells, ",") != "A1,C1" || strings.Join(transfer.DestinationWells, ",") != "B12,A12" || transfer.Volumes[0] != 20 || transfer.NewTip != NewTipAlways {
+		t.Errorf("Transfer should pick sources in well order with new tips. Got: %+v", transfer)
+	}
+
+	// Every invalid row is reported
+	pick.CSV = "Source,From,Dest,To,uL\nsrc,A1,dst,B12,20\nsrc,Z1,dst,B12,20\nsrc,A1,nowhere,B12,20\nsrc,A1,dst,B12,lots\n"
+	body, _ = json.Marshal(pick)
+	req = httptest.NewRequest("POST", "/api/generators/cherry-pick", bytes.NewReader(body))
+	resp = httptest.NewRecorder()
+	app.Router.ServeHTTP(resp, req)
+	if resp.Code != 400 {
+		t.Errorf("Invalid rows should fail with 400. Got: %d", resp.Code)
+	}
+	for _, row := range []string{"row 3: Well Z1", "row 4: Plate nowhere", "row 5: Volume"} {
+		if !strings.Contains(resp.Body.String(), row) {
+			t.Errorf("Error should report %s. Got: %s", row, resp.Body.String())
+		}
+	}
+}
+
+func TestLockApi(t *testing.T) {
+	// Hold the lock with a run that never finishes, like after a crash
+	tx := db.MustBegin()
+	id, err := CreateRun(tx, []byte(`[]`))
+	if err != nil {
+		t.Fatalf("Failed to CreateRun: %s", err)
+	}
+	err = AcquireLock(tx, id)
+	if err != nil {
+		t.Fatalf("Failed to AcquireLock: %s", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		t.Fatalf("Failed to commit: %s", err)
+	}
+
+	// New runs should conflict with the stale run
+	m, _ := EncodeProtocol([]CommandInput{CommandXyz{257, 0, 307, 0, 0.7071067811865476, 0, -0.7071067811865476}})
+	req := httptest.NewRequest("POST", "/api/protocols", bytes.NewReader(m))
+	resp := httptest.NewRecorder()
+	app.Router.ServeHTTP(resp, req)
+	if resp.Code != 409 {
+		t.Errorf("Protocol should conflict with the lock. Got: %d", resp.Code)
+	}
+	if resp.Body.String() != (LockedError{id}).Error() {
+		t.Errorf("Conflict should name run %d. Got: %s", id, resp.Body.String())
+	}
+
+	// Force release the lock
+	req = httptest.NewRequest("DELETE", "/api/lock", nil)
+	resp = httptest.NewRecorder()
+	app.Router.ServeHTTP(resp, req)
 	success := `{"message":"successful"}`
 	if strings.TrimSpace(resp.Body.String()) != success {
 		t.Errorf("Unexpected response. Expected: " + success + "\nGot: " + resp.Body.String())
 	}
+	stale := waitForRun(t, id)
+	if stale.Status != RunFailed {
+		t.Errorf("Stale run should be FAILED. Got: %s", stale.Status)
+	}
+
+	// Now the protocol can run, and releases the lock when done
+	req = httptest.NewRequest("POST", "/api/protocols", bytes.NewReader(m))
+	resp = httptest.NewRecorder()
+	app.Router.ServeHTTP(resp, req)
+	var run Run
+	err = json.Unmarshal(resp.Body.Bytes(), &run)
+	if err != nil {
+		t.Fatalf("Unmarshal of run should succeed. Got error: %s, body: %s", err, resp.Body.String())
+	}
+	waitForRun(t, run.ID)
+
+	req = httptest.NewRequest("GET", "/api/lock", nil)
+	resp = httptest.NewRecorder()
+	app.Router.ServeHTTP(resp, req)
+	var lock Lock
+	err = json.Unmarshal(resp.Body.Bytes(), &lock)
+	if err != nil {
+		t.Errorf("Unmarshal of lock should succeed. Got error: %s", err)
+	}
+	if lock.Active || lock.LockedBy != nil {
+		t.Errorf("Lock should be released after the run. Got: %+v", lock)
+	}
+}
+
+func TestRunEventsApi(t *testing.T) {
+	var moves []CommandInput
+	moves = append(moves, CommandXyz{257, 0, 287, 0, 0.7071067811865476, 0, -0.7071067811865476})
+	moves = append(moves, CommandMove{Deck: "deck", Location: "1", LabwareName: "nest_96_wellplate_100ul_pcr_full_skirt", Address: "A1", DepthFromBottom: 1})
+	id, err := app.Runner.Start(moves, DefaultOptimizeOptions)
+	if err != nil {
+		t.Fatalf("Failed to start run: %s", err)
+	}
+
+	// Stream events until the run ends
+	req := httptest.NewRequest("GET", fmt.Sprintf("/api/runs/%d/events", id), nil)
+	resp := httptest.NewRecorder()
+	app.Router.ServeHTTP(resp, req)
+	if resp.Header().Get("Content-Type") != "text/event-stream" {
+		t.Errorf("Events should be an event stream. Got: %s", resp.Header().Get("Content-Type"))
+	}
+	events := parseEvents(t, resp.Body.String())
+	// One status event either side of 4 started and completed commands
+	if len(events) != 10 {
+		t.Fatalf("Should have streamed 10 events. Got %d: %s", len(events), resp.Body.String())
+	}
+	if events[0].Status != RunRunning || events[9].Status != RunCompleted {
+		t.Errorf("Events should go from RUNNING to COMPLETED. Got: %s to %s", events[0].Status, events[9].Status)
+	}
+	if events[3].Type != EventCommandStarted || *events[3].CommandIndex != 1 || events[3].Pose == nil {
+		t.Errorf("Fourth event should start command 1. Got: %+v", events[3])
+	}
+
+	// Reconnecting replays only the missed events
+	req = httptest.NewRequest("GET", fmt.Sprintf("/api/runs/%d/events", id), nil)
+	req.Header.Set("Last-Event-ID", strconv.FormatInt(events[6].ID, 10))
+	resp = httptest.NewRecorder()
+	app.Router.ServeHTTP(resp, req)
+	replayed := parseEvents(t, resp.Body.String())
+	if len(replayed) != 3 || replayed[0].ID != events[7].ID {
+		t.Errorf("Should have replayed the last 3 events. Got: %s", resp.Body.String())
+	}
+}
+
+// parseEvents parses the data of a Server-Sent Events stream of RunEvents.
+func parseEvents(t *testing.T, stream string) []RunEvent {
+	var events []RunEvent
+	for _, line := range strings.Split(stream, "\n") {
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		var event RunEvent
+		err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event)
+		if err != nil {
+			t.Fatalf("Failed to unmarshal event %s: %s", line, err)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+// gatedArm is an arm that signals moving when a move starts and then waits
+// on gate, so tests can act while a command is in progress.
+type gatedArm struct {
+	ar3.Arm
+	moving chan struct{}
+	gate   chan struct{}
+}
+
+func newGatedArm(arm ar3.Arm) gatedArm {
+	return gatedArm{arm, make(chan struct{}), make(chan struct{})}
+}
+
+func (a gatedArm) Move(speed, accdur, accspd, dccdur, dccspd int, pose kinematics.Pose) error {
+	a.moving <- struct{}{}
+	<-a.gate
+	return a.Arm.Move(speed, accdur, accspd, dccdur, dccspd, pose)
+}
+
+func TestSimulateDuringRun(t *testing.T) {
+	arm := newGatedArm(app.ArmMock)
+	app.Runner.Arm = arm
+	pipette := ConnectMockPipette(300)
+	_ = pipette.PickUpTip()
+	app.Runner.Pipette = pipette
+	defer func() { app.Runner.Arm, app.Runner.Pipette = app.Arm, app.Pipette }()
+
+	plate := Placement{Deck: "deck", Location: "1", LabwareName: "nest_96_wellplate_100ul_pcr_full_skirt"}
+	id, err := app.Runner.Start([]CommandInput{CommandAspirate{Placement: plate, Address: "A1", Volume: 10, DepthFromBottom: 1}}, DefaultOptimizeOptions)
+	if err != nil {
+		t.Fatalf("Failed to start run: %s", err)
+	}
+	<-arm.moving
+
+	// Previews start from an empty pipette, not the tip of the run
+	tipRack := Placement{Deck: "deck", Location: "1", LabwareName: "opentrons_96_tiprack_300ul"}
+	_, err = SimulateProtocol(app.DB, pipette, []CommandInput{CommandPickUpTip{Placement: tipRack}}, DefaultOptimizeOptions)
+	if err != nil {
+		t.Errorf("Simulating during a run should succeed. Got error: %s", err)
+	}
+	for i := 0; i < 3; i++ {
+		arm.gate <- struct{}{}
+		if i < 2 {
+			<-arm.moving
+		}
+	}
+	run := waitForRun(t, id)
+	if run.Status != RunCompleted {
+		t.Errorf("Run should have COMPLETED. Got: %s", run.Status)
+	}
+}
+
+func TestReleaseLockOfActiveRun(t *testing.T) {
+	arm := newGatedArm(app.ArmMock)
+	app.Runner.Arm = arm
+	defer func() { app.Runner.Arm = app.Arm }()
+
+	id, err := app.Runner.Start([]CommandInput{CommandXyz{257, 0, 287, 0, 0.7071067811865476, 0, -0.7071067811865476}}, DefaultOptimizeOptions)
+	if err != nil {
+		t.Fatalf("Failed to start run: %s", err)
+	}
+	<-arm.moving
+
+	// The lock of a run that is still moving the arm is not force released
+	req := httptest.NewRequest("DELETE", "/api/lock", nil)
+	resp := httptest.NewRecorder()
+	app.Router.ServeHTTP(resp, req)
+	if resp.Code != 409 {
+		t.Errorf("Force release should fail with 409 while the run is active. Got: %d %s", resp.Code, resp.Body.String())
+	}
+	arm.gate <- struct{}{}
+	run := waitForRun(t, id)
+	if run.Status != RunCompleted {
+		t.Errorf("Run should have COMPLETED. Got: %s", run.Status)
+	}
+}
+
+func TestRunControlApi(t *testing.T) {
+	arm := newGatedArm(app.ArmMock)
+	app.Runner.Arm = arm
+	defer func() { app.Runner.Arm = app.Arm }()
+
+	var moves []CommandInput
+	moves = append(moves, CommandXyz{257, 0, 287, 0, 0.7071067811865476, 0, -0.7071067811865476})
+	moves = append(moves, CommandXyz{257, 0, 307, 0, 0.7071067811865476, 0, -0.7071067811865476})
+	moves = append(moves, CommandXyz{257, 0, 287, 0, 0.7071067811865476, 0, -0.7071067811865476})
+	id, err := app.Runner.Start(moves, DefaultOptimizeOptions)
+	if err != nil {
+		t.Fatalf("Failed to start run: %s", err)
+	}
+
+	// Pause during the first move
+	<-arm.moving
+	success := `{"message":"successful"}`
+	req := httptest.NewRequest("POST", fmt.Sprintf("/api/runs/%d/pause", id), nil)
+	resp := httptest.NewRecorder()
+	app.Router.ServeHTTP(resp, req)
+	if strings.TrimSpace(resp.Body.String()) != success {
+		t.Errorf("Unexpected response. Expected: " + success + "\nGot: " + resp.Body.String())
+	}
+	arm.gate <- struct{}{}
+	run := waitForRun(t, id)
+	if run.Status != RunPaused {
+		t.Fatalf("Run should be PAUSED. Got: %s", run.Status)
+	}
+	if run.LastCommand == nil || *run.LastCommand != 0 {
+		t.Errorf("Paused run should have completed command 0. Got: %v", run.LastCommand)
+	}
+
+	// Resume and finish the remaining moves
+	req = httptest.NewRequest("POST", fmt.Sprintf("/api/runs/%d/resume", id), nil)
+	resp = httptest.NewRecorder()
+	app.Router.ServeHTTP(resp, req)
+	if strings.TrimSpace(resp.Body.String()) != success {
+		t.Errorf("Unexpected response. Expected: " + success + "\nGot: " + resp.Body.String())
+	}
+	for i := 0; i < 2; i++ {
+		<-arm.moving
+		arm.gate <- struct{}{}
+	}
+	run = waitForRun(t, id)
+	if run.Status != RunCompleted || *run.LastCommand != 2 {
+		t.Errorf("Resumed run should complete all commands. Got: %s after command %d", run.Status, *run.LastCommand)
+	}
+
+	// Cancel a second run during its first move
+	id, err = app.Runner.Start(moves, DefaultOptimizeOptions)
+	if err != nil {
+		t.Fatalf("Failed to start second run: %s", err)
+	}
+	<-arm.moving
+	req = httptest.NewRequest("POST", fmt.Sprintf("/api/runs/%d/cancel", id), nil)
+	resp = httptest.NewRecorder()
+	app.Router.ServeHTTP(resp, req)
+	if strings.TrimSpace(resp.Body.String()) != success {
+		t.Errorf("Unexpected response. Expected: " + success + "\nGot: " + resp.Body.String())
+	}
+	arm.gate <- struct{}{}
+	run = waitForRun(t, id)
+	if run.Status != RunCancelled || *run.LastCommand != 0 {
+		t.Errorf("Run should be CANCELLED after command 0. Got: %s", run.Status)
+	}
+
+	// Finished runs can no longer be controlled
+	req = httptest.NewRequest("POST", fmt.Sprintf("/api/runs/%d/resume", id), nil)
+	resp = httptest.NewRecorder()
+	app.Router.ServeHTTP(resp, req)
+	if resp.Code != 400 {
+		t.Errorf("Resuming a finished run should fail. Got: %d", resp.Code)
+	}
+}
+
+func TestPauseCommandApi(t *testing.T) {
+	protocol, _ := EncodeProtocol([]CommandInput{
+		CommandXyz{257, 0, 287, 0, 0.7071067811865476, 0, -0.7071067811865476},
+		CommandPause{Message: "Swap the plate"},
+		CommandWait{WaitTime: 10},
+		CommandXyz{257, 0, 307, 0, 0.7071067811865476, 0, -0.7071067811865476},
+	})
+	req := httptest.NewRequest("POST", "/api/protocols", bytes.NewReader(protocol))
+	resp := httptest.NewRecorder()
+	app.Router.ServeHTTP(resp, req)
+	var run Run
+	err := json.Unmarshal(resp.Body.Bytes(), &run)
+	if err != nil {
+		t.Fatalf("Unmarshal of run should succeed. Got error: %s, body: %s", err, resp.Body.String())
+	}
+
+	// The run pauses itself with the operator message
+	run = waitForRun(t, run.ID)
+	if run.Status != RunPaused || run.StatusMessage == nil || *run.StatusMessage != "Swap the plate" {
+		t.Fatalf("Run should be PAUSED with the operator message. Got: %s %v", run.Status, run.StatusMessage)
+	}
+	if run.LastCommand == nil || *run.LastCommand != 0 {
+		t.Errorf("Paused run should have completed command 0. Got: %v", run.LastCommand)
+	}
+	tx := db.MustBegin()
+	events, err := GetRunEvents(tx, run.ID, 0)
+	_ = tx.Rollback()
+	if err != nil {
+		t.Fatalf("Failed to GetRunEvents. Got error: %s", err)
+	}
+	last := events[len(events)-1]
+	if last.Type != EventStatus || last.Status != RunPaused || last.Message != "Swap the plate" {
+		t.Errorf("Pause should be recorded in the run log. Got: %+v", last)
+	}
+
+	// Resume and finish the run
+	req = httptest.NewRequest("POST", fmt.Sprintf("/api/runs/%d/resume", run.ID), nil)
+	resp = httptest.NewRecorder()
+	app.Router.ServeHTTP(resp, req)
+	if resp.Code != 200 {
+		t.Errorf("Resume should succeed. Got: %d %s", resp.Code, resp.Body.String())
+	}
+	// The run is still PAUSED until it picks up the resume
+	for i := 0; i < 200 && run.Status == RunPaused; i++ {
+		time.Sleep(10 * time.Millisecond)
+		run = waitForRun(t, run.ID)
+	}
+	if run.Status != RunCompleted || *run.LastCommand != 3 {
+		t.Errorf("Resumed run should complete all commands. Got: %s after command %d", run.Status, *run.LastCommand)
+	}
+}
+
+func TestEStopApi(t *testing.T) {
+	arm := newGatedArm(app.ArmMock)
+	app.Runner.Arm = arm
+	defer func() { app.Runner.Arm = app.Arm }()
+
+	moves := []CommandInput{CommandXyz{257, 0, 287, 0, 0.7071067811865476, 0, -0.7071067811865476}, CommandXyz{257, 0, 307, 0, 0.7071067811865476, 0, -0.7071067811865476}}
+	id, err := app.Runner.Start(moves, DefaultOptimizeOptions)
+	if err != nil {
+		t.Fatalf("Failed to start run: %s", err)
+	}
+	<-arm.moving
+
+	// Press the emergency stop during the first move
+	success := `{"message":"successful"}`
+	req := httptest.NewRequest("POST", "/api/estop", nil)
+	resp := httptest.NewRecorder()
+	app.Router.ServeHTTP(resp, req)
+	if strings.TrimSpace(resp.Body.String()) != success {
+		t.Errorf("Unexpected response. Expected: " + success + "\nGot: " + resp.Body.String())
+	}
+	run := waitForRun(t, id)
+	if run.Status != RunFailed || *run.StatusMessage != "estop" {
+		t.Errorf("Run should have FAILED with estop. Got: %s", run.Status)
+	}
+
+	// Motion is refused while latched
+	m, _ := EncodeProtocol(moves)
+	req = httptest.NewRequest("POST", "/api/protocols", bytes.NewReader(m))
+	resp = httptest.NewRecorder()
+	app.Router.ServeHTTP(resp, req)
+	if resp.Code != 503 {
+		t.Errorf("Protocols should be refused while estopped. Got: %d", resp.Code)
+	}
+
+	// Reset is refused until the stopped move finishes
+	req = httptest.NewRequest("POST", "/api/estop/reset", nil)
+	resp = httptest.NewRecorder()
+	app.Router.ServeHTTP(resp, req)
+	if resp.Code != 400 {
+		t.Errorf("Reset should fail while the run is stopping. Got: %d", resp.Code)
+	}
+	arm.gate <- struct{}{}
+	for i := 0; i < 200 && resp.Code != 200; i++ {
+		time.Sleep(10 * time.Millisecond)
+		req = httptest.NewRequest("POST", "/api/estop/reset", nil)
+		resp = httptest.NewRecorder()
+		app.Router.ServeHTTP(resp, req)
+	}
+	if strings.TrimSpace(resp.Body.String()) != success {
+		t.Errorf("Unexpected response. Expected: " + success + "\nGot: " + resp.Body.String())
+	}
+	run = waitForRun(t, id)
+	if run.Status != RunFailed || *run.StatusMessage != "estop" || *run.LastCommand != 0 {
+		t.Errorf("Stopped run should have FAILED with estop after command 0. Got: %s", run.Status)
+	}
+
+	req = httptest.NewRequest("GET", "/api/estop", nil)
+	resp = httptest.NewRecorder()
+	app.Router.ServeHTTP(resp, req)
+	if strings.TrimSpace(resp.Body.String()) != `{"latched":false}` {
+		t.Errorf("Emergency stop should be reset. Got: %s", resp.Body.String())
+	}
+}
+
+// estopArm presses the emergency stop of a Runner when Runner.Start checks
+// where the arm is, before the new run is registered, and then tries to
+// reset it.
+type estopArm struct {
+	ar3.Arm
+	runner *Runner
+	moves  *int
+	reset  *error
+}
+
+func (a estopArm) CurrentJointRadians() [7]float64 {
+	_ = a.runner.EStop()
+	*a.reset = a.runner.ResetEStop()
+	return a.Arm.CurrentJointRadians()
+}
+
+func (a estopArm) Move(speed, accdur, accspd, dccdur, dccspd int, pose kinematics.Pose) error {
+	*a.moves++
+	return a.Arm.Move(speed, accdur, accspd, dccdur, dccspd, pose)
+}
+
+func TestEStopDuringStart(t *testing.T) {
+	moves := 0
+	var reset error
+	app.Runner.Arm = estopArm{app.ArmMock, app.Runner, &moves, &reset}
+	defer func() { app.Runner.Arm = app.Arm }()
+
+	_, err := app.Runner.Start([]CommandInput{CommandXyz{257, 0, 287, 0, 0.7071067811865476, 0, -0.7071067811865476}}, DefaultOptimizeOptions)
+	if _, ok := err.(EStopError); !ok {
+		t.Errorf("Start should fail once the emergency stop is pressed. Got: %v", err)
+	}
+	tx := db.MustBegin()
+	runs, _ := GetRuns(tx)
+	lock, _ := GetLock(tx)
+	_ = tx.Rollback()
+	last := runs[len(runs)-1]
+	if last.Status != RunFailed || *last.StatusMessage != "estop" {
+		t.Errorf("Run should have FAILED with estop. Got: %s", last.Status)
+	}
+	if lock.Active {
+		t.Errorf("Lock should be released")
+	}
+	if reset == nil || reset.Error() != "A run is still starting" {
+		t.Errorf("Reset should wait for the run to finish starting. Got: %v", reset)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if moves != 0 {
+		t.Errorf("Arm should not move while the emergency stop is latched. Got %d moves", moves)
+	}
+
+	app.Runner.Arm = app.Arm
+	err = app.Runner.ResetEStop()
+	if err != nil {
+		t.Errorf("Failed to reset emergency stop. Got error: %s", err)
+	}
+}
+
+// homingArm is an arm that signals calibrating when it starts homing and
+// then waits for its gate.
+type homingArm struct {
+	ar3.Arm
+	calibrating chan struct{}
+	gate        chan struct{}
+}
+
+func (a homingArm) Calibrate(speed int, j1, j2, j3, j4, j5, j6, tr bool) error {
+	a.calibrating <- struct{}{}
+	<-a.gate
+	return a.Arm.Calibrate(speed, j1, j2, j3, j4, j5, j6, tr)
+}
+
+func TestEStopDuringReset(t *testing.T) {
+	arm := homingArm{app.ArmMock, make(chan struct{}), make(chan struct{})}
+	app.Runner.Arm = arm
+	defer func() { app.Runner.Arm = app.Arm }()
+	_ = app.Runner.EStop()
+
+	reset := make(chan error)
+	go func() { reset <- app.Runner.ResetEStop() }()
+	<-arm.calibrating
+
+	// The emergency stop can be read and pressed while the arm re-homes
+	if !app.Runner.EStopped() {
+		t.Errorf("Emergency stop should stay latched while re-homing")
+	}
+	if app.Runner.ResetEStop() == nil {
+		t.Errorf("A second reset should fail while re-homing")
+	}
+	_ = app.Runner.EStop()
+	arm.gate <- struct{}{}
+	if <-reset == nil || !app.Runner.EStopped() {
+		t.Errorf("Pressing the emergency stop should abort the reset")
+	}
+
+	go func() { reset <- app.Runner.ResetEStop() }()
+	<-arm.calibrating
+	arm.gate <- struct{}{}
+	if err := <-reset; err != nil || app.Runner.EStopped() {
+		t.Errorf("Reset should release the emergency stop. Got: %v", err)
+	}
+}
+
+// waitForRun polls a run until it is no longer RUNNING.
+func waitForRun(t *testing.T, id int64) Run {
+	var run Run
+	for i := 0; i < 200; i++ {
+		req := httptest.NewRequest("GET", fmt.Sprintf("/api/runs/%d", id), nil)
+		resp := httptest.NewRecorder()
+		app.Router.ServeHTTP(resp, req)
+		err := json.Unmarshal(resp.Body.Bytes(), &run)
+		if err != nil {
+			t.Fatalf("Unmarshal of run should succeed. Got error: %s, body: %s", err, resp.Body.String())
+		}
+		if run.Status != RunRunning {
+			return run
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("Run %d did not finish", id)
+	return run
 }
@@ -1,14 +1,29 @@
 package main
 
 import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
 	"embed"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/jmoiron/sqlx"
 	"github.com/trilobio/ar3"
 	"github.com/trilobio/kinematics"
 	"io/fs"
 	"io/ioutil"
+	"log"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 /******************************************************************************
@@ -18,70 +33,558 @@ import (
 ******************************************************************************/
 
 type Well struct {
-	Address  string  `json:"address" db:"address"`
-	Depth    float64 `json:"depth" db:"depth"`
-	Diameter float64 `json:"diameter" db:"diameter"`
-	X        float64 `json:"x" db:"x"`
-	Y        float64 `json:"y" db:"y"`
-	Z        float64 `json:"z" db:"z"`
+	Address           string  `json:"address" db:"address"`
+	Depth             float64 `json:"depth" db:"depth"`
+	Shape             string  `json:"shape" db:"shape"`           // circular or rectangular
+	Diameter          float64 `json:"diameter" db:"diameter"`     // Circular wells
+	XDimension        float64 `json:"xDimension" db:"xdimension"` // Rectangular wells
+	YDimension        float64 `json:"yDimension" db:"ydimension"` // Rectangular wells
+	TotalLiquidVolume float64 `json:"totalLiquidVolume" db:"total_liquid_volume"`
+	X                 float64 `json:"x" db:"x"`
+	Y                 float64 `json:"y" db:"y"`
+	Z                 float64 `json:"z" db:"z"`
 }
 
+// Labware follows the Opentrons labware schema v2. Ordering lists the well
+// addresses column by column, and Groups describe wells that share
+// properties, such as the shape of their bottom. Several versions of a
+// labware may be stored under the same name.
 type Labware struct {
-	Name string `json:"name" db:"name"`
-	//XDimension float64 `json:"xDimension"` // Microplate: 127.76
-	//YDimension float64 `json:"yDimension"` // Microplate: 85.48
-	ZDimension float64 `json:"zDimension" db:"zdimension"`
-	Wells      []Well  `json:"wells"`
+	Name                       string       `json:"name" db:"name"`
+	Version                    int          `json:"version" db:"version"`
+	Namespace                  string       `json:"namespace" db:"namespace"` // Opentrons: opentrons or custom_beta
+	DisplayName                string       `json:"displayName" db:"display_name"`
+	DisplayCategory            string       `json:"displayCategory" db:"display_category"`
+	DisplayVolumeUnits         string       `json:"displayVolumeUnits" db:"display_volume_units"` // µL, mL or L
+	Tags                       LabwareTags  `json:"tags" db:"tags"`
+	Brand                      LabwareBrand `json:"brand" db:"brand"`
+	Format                     string       `json:"format" db:"format"`         // Opentrons: 96Standard, irregular, ...
+	XDimension                 float64      `json:"xDimension" db:"xdimension"` // Microplate: 127.76
+	YDimension                 float64      `json:"yDimension" db:"ydimension"` // Microplate: 85.48
+	ZDimension                 float64      `json:"zDimension" db:"zdimension"`
+	CornerOffsetFromSlot       Offset       `json:"cornerOffsetFromSlot" db:"corner_offset_from_slot"`
+	IsTiprack                  bool         `json:"isTiprack" db:"is_tiprack"`
+	IsMagneticModuleCompatible bool         `json:"isMagneticModuleCompatible" db:"is_magnetic_module_compatible"`
+	TipLength                  float64      `json:"tipLength" db:"tip_length"`
+	TipOverlap                 float64      `json:"tipOverlap" db:"tip_overlap"`
+	Ordering                   WellOrdering `json:"ordering" db:"ordering"`
+	Groups                     WellGroups   `json:"groups" db:"groups"`
+	Wells                      []Well       `json:"wells"`
 }
 
+type LabwareBrand struct {
+	Brand   string   `json:"brand"`
+	BrandID []string `json:"brandId,omitempty"`
+	Links   []string `json:"links,omitempty"`
+}
+
+type Offset struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+	Z float64 `json:"z"`
+}
+
+type LabwareTags []string
+
+type WellOrdering [][]string
+
+type WellGroups []WellGroup
+
+type WellGroup struct {
+	Metadata WellGroupMetadata `json:"metadata"`
+	Brand    *LabwareBrand     `json:"brand,omitempty"` // Brand of the wells, such as tubes in a rack
+	Wells    []string          `json:"wells"`
+}
+
+type WellGroupMetadata struct {
+	DisplayName     string `json:"displayName,omitempty"`
+	DisplayCategory string `json:"displayCategory,omitempty"`
+	WellBottomShape string `json:"wellBottomShape,omitempty"` // flat, u or v
+}
+
+// The composite fields of a Labware are stored as JSON text.
+func (b *LabwareBrand) Scan(src interface{}) error  { return scanJSON(src, b) }
+func (b LabwareBrand) Value() (driver.Value, error) { return valueJSON(b) }
+func (t *LabwareTags) Scan(src interface{}) error   { return scanJSON(src, t) }
+func (t LabwareTags) Value() (driver.Value, error)  { return valueJSON(t) }
+func (o *Offset) Scan(src interface{}) error        { return scanJSON(src, o) }
+func (o Offset) Value() (driver.Value, error)       { return valueJSON(o) }
+func (o *WellOrdering) Scan(src interface{}) error  { return scanJSON(src, o) }
+func (o WellOrdering) Value() (driver.Value, error) { return valueJSON(o) }
+func (g *WellGroups) Scan(src interface{}) error    { return scanJSON(src, g) }
+func (g WellGroups) Value() (driver.Value, error)   { return valueJSON(g) }
+
+func scanJSON(src interface{}, dest interface{}) error {
+	switch src := src.(type) {
+	case nil:
+		return nil
+	case string:
+		return json.Unmarshal([]byte(src), dest)
+	case []byte:
+		return json.Unmarshal(src, dest)
+	}
+	return fmt.Errorf("Cannot scan %T as JSON", src)
+}
+
+func valueJSON(v interface{}) (driver.Value, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+const wellColumns = "address, depth, shape, diameter, xdimension, ydimension, total_liquid_volume, x, y, z"
+
+// defaultVersion selects the default version of a labware row: the version
+// set with SetDefaultLabwareVersion, or else the latest version.
+const defaultVersion = `version = COALESCE(
+	(SELECT version FROM labware_default WHERE labware_default.name = labware.name),
+	(SELECT MAX(version) FROM labware AS latest WHERE latest.name = labware.name))`
+
+// GetLabwares gets the default version of every labware.
 func GetLabwares(tx *sqlx.Tx) ([]Labware, error) {
 	var labwares []Labware
-	err := tx.Select(&labwares, "SELECT * FROM labware")
+	err := tx.Select(&labwares, "SELECT * FROM labware WHERE "+defaultVersion)
 	if err != nil {
 		return labwares, err
 	}
-	for i, labware := range labwares {
-		var wells []Well
-		err = tx.Select(&wells, "SELECT address, depth, diameter, x, y, z FROM well WHERE labware = ?", labware.Name)
-		if err != nil {
-			return labwares, err
-		}
-		labwares[i].Wells = wells
+	err = getWells(tx, labwares)
+	if err != nil {
+		return labwares, err
 	}
 	return labwares, nil
 
 }
 
+// GetLabware gets the default version of a labware.
 func GetLabware(tx *sqlx.Tx, name string) (Labware, error) {
 	var labware Labware
-	err := tx.Get(&labware, "SELECT * FROM labware WHERE name = ?", name)
+	err := tx.Get(&labware, "SELECT * FROM labware WHERE name = ? AND "+defaultVersion, name)
 	if err != nil {
 		return labware, err
 	}
-	var wells []Well
-	err = tx.Select(&wells, "SELECT address, depth, diameter, x, y, z FROM well WHERE labware = ?", name)
+	labwares := []Labware{labware}
+	err = getWells(tx, labwares)
 	if err != nil {
 		return labware, err
 	}
-	labware.Wells = wells
-	return labware, nil
+	return labwares[0], nil
+
+}
+
+// GetLabwareVersion gets a single version of a labware.
+func GetLabwareVersion(tx *sqlx.Tx, name string, version int) (Labware, error) {
+	var labware Labware
+	err := tx.Get(&labware, "SELECT * FROM labware WHERE name = ? AND version = ?", name, version)
+	if err != nil {
+		return labware, err
+	}
+	labwares := []Labware{labware}
+	err = getWells(tx, labwares)
+	if err != nil {
+		return labware, err
+	}
+	return labwares[0], nil
+}
+
+// GetLabwareVersions gets every version of a labware, oldest first.
+func GetLabwareVersions(tx *sqlx.Tx, name string) ([]Labware, error) {
+	labwares := []Labware{}
+	err := tx.Select(&labwares, "SELECT * FROM labware WHERE name = ? ORDER BY version", name)
+	if err != nil {
+		return labwares, err
+	}
+	if len(labwares) == 0 {
+		return labwares, sql.ErrNoRows
+	}
+	err = getWells(tx, labwares)
+	if err != nil {
+		return labwares, err
+	}
+	return labwares, nil
+}
+
+func getWells(tx *sqlx.Tx, labwares []Labware) error {
+	for i, labware := range labwares {
+		var wells []Well
+		err := tx.Select(&wells, "SELECT "+wellColumns+" FROM well WHERE labware = ? AND version = ? ORDER BY rowid", labware.Name, labware.Version)
+		if err != nil {
+			return err
+		}
+		labwares[i].Wells = wells
+	}
+	return nil
+}
+
+// LabwareViolation is a single problem with a labware. Field is the path of
+// the invalid field, such as wells.A1.depth.
+type LabwareViolation struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// LabwareValidationError lists every violation of an invalid labware.
+type LabwareValidationError struct {
+	Violations []LabwareViolation `json:"violations"`
+}
+
+func (e LabwareValidationError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Labware has %d violations:", len(e.Violations))
+	for _, violation := range e.Violations {
+		fmt.Fprintf(&b, "\n%s: %s", violation.Field, violation.Message)
+	}
+	return b.String()
+}
+
+// labwareTolerance allows for rounding in the dimensions of a labware, in
+// mm.
+const labwareTolerance = 1e-6
+
+// ValidateLabware checks that a labware is physically consistent, returning a
+// LabwareValidationError with every violation. Wells without a shape are
+// circular. Wells must be within the footprint of the labware, which is only
+// checked along the dimensions that are set, and below the top of the
+// labware, except for the tips of tip racks.
+func ValidateLabware(labware Labware) error {
+	return validateLabware(labware, false)
+}
+
+// validateLabware checks a labware as ValidateLabware. Some of the embedded
+// definitions do not fit their own dimensions: tubes stand above their racks
+// and blocks, and the opening of the fixed trash overhangs its slot. Those
+// checks are relaxed for embedded definitions only, since a client could
+// otherwise skip them by setting the display category of a labware.
+func validateLabware(labware Labware, embedded bool) error {
+	var violations []LabwareViolation
+	violate := func(field string, format string, a ...interface{}) {
+		violations = append(violations, LabwareViolation{Field: field, Message: fmt.Sprintf(format, a...)})
+	}
+
+	if labware.Name == "" {
+		violate("name", "is required")
+	}
+	if labware.Version < 0 {
+		violate("version", "must not be negative")
+	}
+	if labware.XDimension < 0 {
+		violate("xDimension", "must not be negative")
+	}
+	if labware.YDimension < 0 {
+		violate("yDimension", "must not be negative")
+	}
+	if labware.ZDimension <= 0 {
+		violate("zDimension", "must be positive")
+	}
+	if labware.IsTiprack && labware.TipLength <= 0 {
+		violate("tipLength", "is required for tip racks")
+	}
+	if len(labware.Wells) == 0 {
+		violate("wells", "labware has no wells")
+	}
+
+	overhangs := embedded && labware.DisplayCategory == "trash"
+	holdsItems := labware.IsTiprack || (embedded && (labware.DisplayCategory == "tubeRack" || labware.DisplayCategory == "aluminumBlock"))
+	wells := make(map[string]bool)
+	for i, well := range labware.Wells {
+		field := "wells." + well.Address
+		if well.Address == "" {
+			field = fmt.Sprintf("wells[%d]", i)
+			violate(field+".address", "is required")
+		} else if wells[well.Address] {
+			violate(field+".address", "is not unique")
+		}
+		wells[well.Address] = true
+
+		if well.Depth < 0 {
+			violate(field+".depth", "must not be negative")
+		}
+		switch well.Shape {
+		case "", "circular":
+			if well.Diameter <= 0 {
+				violate(field+".diameter", "must be positive")
+			}
+		case "rectangular":
+			if well.XDimension <= 0 {
+				violate(field+".xDimension", "must be positive")
+			}
+			if well.YDimension <= 0 {
+				violate(field+".yDimension", "must be positive")
+			}
+		default:
+			violate(field+".shape", "must be circular or rectangular, got: %s", well.Shape)
+		}
+
+		// The edges of the well, not only its center, are within the
+		// footprint of the labware, as for generated labware
+		halfX, halfY := well.Diameter/2, well.Diameter/2
+		if well.Shape == "rectangular" {
+			halfX, halfY = well.XDimension/2, well.YDimension/2
+		}
+		if overhangs {
+			halfX, halfY = 0, 0
+		}
+		if labware.XDimension > 0 && (well.X-halfX < -labwareTolerance || well.X+halfX > labware.XDimension+labwareTolerance) {
+			violate(field+".x", "well is outside the %gmm width of the labware", labware.XDimension)
+		}
+		if labware.YDimension > 0 && (well.Y-halfY < -labwareTolerance || well.Y+halfY > labware.YDimension+labwareTolerance) {
+			violate(field+".y", "well is outside the %gmm length of the labware", labware.YDimension)
+		}
+		if well.Z < 0 {
+			violate(field+".z", "must not be negative")
+		}
+		if !holdsItems && labware.ZDimension > 0 && well.Z+well.Depth > labware.ZDimension+labwareTolerance {
+			violate(field+".z", "top of the well is above the %gmm height of the labware", labware.ZDimension)
+		}
+	}
+
+	// An ordering, if given, has every well exactly once
+	ordered := make(map[string]bool)
+	for _, column := range labware.Ordering {
+		for _, address := range column {
+			if !wells[address] {
+				violate("ordering", "has unknown well %s", address)
+			} else if ordered[address] {
+				violate("ordering", "has well %s more than once", address)
+			}
+			ordered[address] = true
+		}
+	}
+	if len(labware.Ordering) > 0 {
+		for _, well := range labware.Wells {
+			if !ordered[well.Address] {
+				violate("ordering", "is missing well %s", well.Address)
+			}
+		}
+	}
+	for i, group := range labware.Groups {
+		for _, address := range group.Wells {
+			if !wells[address] {
+				violate(fmt.Sprintf("groups[%d]", i), "has unknown well %s", address)
+			}
+		}
+	}
 
+	if len(violations) > 0 {
+		return LabwareValidationError{Violations: violations}
+	}
+	return nil
 }
 
+// CreateLabware validates and stores a version of a labware, version 1 if it
+// has none.
 func CreateLabware(tx *sqlx.Tx, labware Labware) error {
-	_, err := tx.Exec("INSERT INTO labware(name, zdimension) VALUES (?, ?)", labware.Name, labware.ZDimension)
+	return createLabware(tx, labware, false)
+}
+
+// createLabware stores a labware, validated as an embedded definition or
+// not.
+func createLabware(tx *sqlx.Tx, labware Labware, embedded bool) error {
+	if labware.Version == 0 {
+		labware.Version = 1
+	}
+	err := validateLabware(labware, embedded)
+	if err != nil {
+		return err
+	}
+	var exists bool
+	err = tx.Get(&exists, "SELECT EXISTS(SELECT 1 FROM labware WHERE name = ? AND version = ?)", labware.Name, labware.Version)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf("Labware %s version %d already exists", labware.Name, labware.Version)
+	}
+	_, err = tx.NamedExec(`INSERT INTO labware(name, version, namespace, display_name, display_category, display_volume_units, tags, brand, format, xdimension, ydimension, zdimension, corner_offset_from_slot, is_tiprack, is_magnetic_module_compatible, tip_length, tip_overlap, ordering, groups)
+		VALUES (:name, :version, :namespace, :display_name, :display_category, :display_volume_units, :tags, :brand, :format, :xdimension, :ydimension, :zdimension, :corner_offset_from_slot, :is_tiprack, :is_magnetic_module_compatible, :tip_length, :tip_overlap, :ordering, :groups)`, labware)
 	if err != nil {
 		return err
 	}
+	return createWells(tx, labware)
+}
+
+func createWells(tx *sqlx.Tx, labware Labware) error {
 	for _, well := range labware.Wells {
-		_, err := tx.Exec("INSERT INTO well(labware, address, depth, diameter, x, y, z) VALUES (?, ?, ?, ?, ?, ?, ?)", labware.Name, well.Address, well.Depth, well.Diameter, well.X, well.Y, well.Z)
+		if well.Shape == "" {
+			well.Shape = "circular"
+		}
+		_, err := tx.Exec("INSERT INTO well(labware, version, "+wellColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", labware.Name, labware.Version, well.Address, well.Depth, well.Shape, well.Diameter, well.XDimension, well.YDimension, well.TotalLiquidVolume, well.X, well.Y, well.Z)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LabwareInUseError is returned when a labware that is being updated is
+// referenced by the active deck layout.
+type LabwareInUseError struct {
+	Name       string
+	Version    int
+	References []string
+}
+
+func (e LabwareInUseError) Error() string {
+	return fmt.Sprintf("Labware %s version %d is in use by %s. Use force to update it anyway", e.Name, e.Version, strings.Join(e.References, ", "))
+}
+
+// StatusCode returns 409 Conflict, since the update may succeed once the
+// labware is no longer in use.
+func (e LabwareInUseError) StatusCode() int { return 409 }
+
+// labwareReferences lists the references to a version of a labware from the
+// active deck layout. The layout is made of the placements of runs that are
+// RUNNING or PAUSED, as compiled when they started, and of the tip racks
+// whose used tips are tracked. Tip racks are tracked by name, so they
+// reference every version.
+func labwareReferences(tx *sqlx.Tx, name string, version int) ([]string, error) {
+	var references []string
+	var tipRacks []TipRack
+	err := tx.Select(&tipRacks, "SELECT DISTINCT deck, location FROM used_tip WHERE labware = ? ORDER BY deck, location", name)
+	if err != nil {
+		return nil, err
+	}
+	for _, tipRack := range tipRacks {
+		references = append(references, fmt.Sprintf("tip rack %s/%s", tipRack.Deck, tipRack.Location))
+	}
+
+	var runs []Run
+	err = tx.Select(&runs, "SELECT id, placements FROM activity_log WHERE status IN (?, ?) ORDER BY id", RunRunning, RunPaused)
+	if err != nil {
+		return nil, err
+	}
+	for _, run := range runs {
+		for _, placement := range run.Placements {
+			if placement.LabwareName == name && placement.LabwareVersion == version {
+				references = append(references, fmt.Sprintf("run %d at %s/%s", run.ID, placement.Deck, placement.Location))
+			}
+		}
+	}
+	return references, nil
+}
+
+// UpdateLabware validates and replaces a stored version of a labware,
+// including all of its wells. Unless force is set, labware in use is not
+// updated and a LabwareInUseError is returned.
+func UpdateLabware(tx *sqlx.Tx, labware Labware, force bool) error {
+	_, err := GetLabwareVersion(tx, labware.Name, labware.Version)
+	if err != nil {
+		return fmt.Errorf("Labware %s has no version %d", labware.Name, labware.Version)
+	}
+	err = ValidateLabware(labware)
+	if err != nil {
+		return err
+	}
+	if !force {
+		references, err := labwareReferences(tx, labware.Name, labware.Version)
 		if err != nil {
 			return err
 		}
+		if len(references) > 0 {
+			return LabwareInUseError{Name: labware.Name, Version: labware.Version, References: references}
+		}
+	}
+
+	_, err = tx.NamedExec(`UPDATE labware SET namespace = :namespace, display_name = :display_name, display_category = :display_category, display_volume_units = :display_volume_units, tags = :tags, brand = :brand, format = :format,
+		xdimension = :xdimension, ydimension = :ydimension, zdimension = :zdimension, corner_offset_from_slot = :corner_offset_from_slot, is_tiprack = :is_tiprack, is_magnetic_module_compatible = :is_magnetic_module_compatible,
+		tip_length = :tip_length, tip_overlap = :tip_overlap, ordering = :ordering, groups = :groups
+		WHERE name = :name AND version = :version`, labware)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM well WHERE labware = ? AND version = ?", labware.Name, labware.Version)
+	if err != nil {
+		return err
+	}
+	return createWells(tx, labware)
+}
+
+// PatchLabware applies a partial update to a labware. The patch is a JSON
+// object of the Labware fields to change, where wells only lists the wells
+// to change by their address, along with the fields to change.
+func PatchLabware(labware Labware, patch []byte) (Labware, error) {
+	var fields map[string]json.RawMessage
+	err := json.Unmarshal(patch, &fields)
+	if err != nil {
+		return labware, err
+	}
+	if _, ok := fields["name"]; ok {
+		return labware, fmt.Errorf("The name of a labware can not be changed")
+	}
+	if _, ok := fields["version"]; ok {
+		return labware, fmt.Errorf("The version of a labware can not be changed")
+	}
+	wellPatches := fields["wells"]
+	delete(fields, "wells")
+
+	rest, err := json.Marshal(fields)
+	if err != nil {
+		return labware, err
+	}
+	err = decodeStrict(rest, &labware)
+	if err != nil {
+		return labware, err
+	}
+	if wellPatches == nil {
+		return labware, nil
+	}
+
+	var patches []json.RawMessage
+	err = json.Unmarshal(wellPatches, &patches)
+	if err != nil {
+		return labware, err
+	}
+	wells := append([]Well{}, labware.Wells...)
+	for _, wellPatch := range patches {
+		var target struct {
+			Address string `json:"address"`
+		}
+		err = json.Unmarshal(wellPatch, &target)
+		if err != nil {
+			return labware, err
+		}
+		index := -1
+		for i, well := range wells {
+			if well.Address == target.Address {
+				index = i
+			}
+		}
+		if index < 0 {
+			return labware, fmt.Errorf("Well %s not in labware", target.Address)
+		}
+		err = decodeStrict(wellPatch, &wells[index])
+		if err != nil {
+			return labware, fmt.Errorf("Well %s: %s", target.Address, err)
+		}
+	}
+	labware.Wells = wells
+	return labware, nil
+}
+
+// decodeStrict decodes JSON, rejecting fields that v does not have, so that
+// a misspelled field is not silently ignored.
+func decodeStrict(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(v)
+}
+
+// SetDefaultLabwareVersion sets the version of a labware that is used when
+// no version is pinned.
+func SetDefaultLabwareVersion(tx *sqlx.Tx, name string, version int) error {
+	_, err := GetLabwareVersion(tx, name, version)
+	if err != nil {
+		return fmt.Errorf("Labware %s has no version %d", name, version)
+	}
+	_, err = tx.Exec("INSERT OR REPLACE INTO labware_default(name, version) VALUES (?, ?)", name, version)
+	if err != nil {
+		return err
 	}
 	return nil
 }
 
+// DeleteLabware deletes every version of a labware.
 func DeleteLabware(tx *sqlx.Tx, name string) error {
 	_, err := tx.Exec("DELETE FROM labware WHERE name = ?", name)
 	if err != nil {
@@ -97,21 +600,25 @@ func DeleteLabware(tx *sqlx.Tx, name string) error {
 ******************************************************************************/
 
 type InputDeck struct {
-	Name      string     `json:"name" db:"name"`
-	Locations []Location `json:"locations"`
+	Name         string     `json:"name" db:"name"`
+	Locations    []Location `json:"locations"`
+	TravelHeight float64    `json:"travel_height" db:"travel_height"`
 }
 
 type Deck struct {
-	Name       string     `json:"name" db:"name"`
-	Calibrated bool       `json:"calibrated" db:"calibrated"`
-	X          float64    `json:"x" db:"x"`
-	Y          float64    `json:"y" db:"y"`
-	Z          float64    `json:"z" db:"z"`
-	Qw         float64    `json:"qw" db:"qw"`
-	Qx         float64    `json:"qx" db:"qx"`
-	Qy         float64    `json:"qy" db:"qy"`
-	Qz         float64    `json:"qz" db:"qz"`
-	Locations  []Location `json:"locations"`
+	Name       string  `json:"name" db:"name"`
+	Calibrated bool    `json:"calibrated" db:"calibrated"`
+	X          float64 `json:"x" db:"x"`
+	Y          float64 `json:"y" db:"y"`
+	Z          float64 `json:"z" db:"z"`
+	Qw         float64 `json:"qw" db:"qw"`
+	Qx         float64 `json:"qx" db:"qx"`
+	Qy         float64 `json:"qy" db:"qy"`
+	Qz         float64 `json:"qz" db:"qz"`
+	// TravelHeight is the height above the deck that clears every labware
+	// on it. The arm travels at this height between labwares, if it is set.
+	TravelHeight float64    `json:"travel_height" db:"travel_height"`
+	Locations    []Location `json:"locations"`
 }
 
 type Location struct {
@@ -160,7 +667,7 @@ func GetDeck(tx *sqlx.Tx, name string) (Deck, error) {
 }
 
 func CreateDeck(tx *sqlx.Tx, deck InputDeck) error {
-	_, err := tx.Exec("INSERT INTO deck(name) VALUES (?)", deck.Name)
+	_, err := tx.Exec("INSERT INTO deck(name, travel_height) VALUES (?, ?)", deck.Name, deck.TravelHeight)
 	if err != nil {
 		return err
 	}
@@ -215,145 +722,3137 @@ type CommandMove struct {
 	Deck            string  `json:"name"`
 	Location        string  `json:"location"`
 	LabwareName     string  `json:"labware_name"`
+	LabwareVersion  int     `json:"labware_version,omitempty"`
 	Address         string  `json:"address"`
 	DepthFromBottom float64 `json:"depth_from_bottom"`
 }
 
 func (c CommandMove) Command() string { return "move" }
 
-type Command struct {
-	Command  string
-	Pose     kinematics.Pose
-	WaitTime int // Milliseconds
+// Placement is a labware placed at a location of a deck. LabwareVersion pins
+// a version of the labware; the default version is used if it is 0.
+type Placement struct {
+	Deck           string `json:"deck"`
+	Location       string `json:"location"`
+	LabwareName    string `json:"labware_name"`
+	LabwareVersion int    `json:"labware_version,omitempty"`
 }
 
-func ExecuteProtocol(db *sqlx.DB, arm ar3.Arm, protocol []CommandInput) error {
-	var err error
-	tx := db.MustBegin()
-	var commands []Command
-	for _, step := range protocol {
-		// Run each different possible command
-		command := step.Command()
-		switch command {
-		case "movexyz":
-			var movexyz CommandXyz
-			movexyz = step.(CommandXyz)
-
-			// Move arm to XYZ position
-			commands = append(commands, Command{"move", kinematics.Pose{Position: kinematics.Position{X: movexyz.X, Y: movexyz.Y, Z: movexyz.Z}, Rotation: kinematics.Quaternion{W: movexyz.Qw, X: movexyz.Qx, Y: movexyz.Qy, Z: movexyz.Qz}}, 0})
-		case "move":
-			var move CommandMove
-			move = step.(CommandMove)
-
-			// Get deck calibration
-			deck, err := GetDeck(tx, move.Deck)
-			if err != nil {
-				return err
-			}
-			if !deck.Calibrated {
-				return fmt.Errorf("Please calibrate the deck")
-			}
-			locations := make(map[string]Location)
-			for _, location := range deck.Locations {
-				locations[location.Name] = location
-			}
-			if _, ok := locations[move.Location]; !ok {
-				return fmt.Errorf("Location not in deck")
-			}
-			targetLocation := locations[move.Location]
+// tipRack identifies the tip rack at a placement, whichever version of its
+// labware is pinned.
+func (p Placement) tipRack() Placement {
+	p.LabwareVersion = 0
+	return p
+}
 
-			// Get labware
-			labware, err := GetLabware(tx, move.LabwareName)
-			if err != nil {
-				return err
-			}
-			wells := make(map[string]Well)
-			for _, well := range labware.Wells {
-				wells[well.Address] = well
-			}
-			if _, ok := wells[move.Address]; !ok {
-				return fmt.Errorf("Well not in labware")
-			}
-			targetWell := wells[move.Address]
-
-			// Move above the well, then into it
-			locationOffsetX := deck.X + targetLocation.X
-			locationOffsetY := deck.Y + targetLocation.Y
-			locationOffsetZ := deck.Z + targetLocation.Z
-			wellOffsetX := locationOffsetX + targetWell.X
-			wellOffsetY := locationOffsetY + targetWell.Y
-			wellTop := locationOffsetZ + targetWell.Z + labware.ZDimension + 5
-			wellBottom := locationOffsetZ + targetWell.Z + move.DepthFromBottom
-
-			rotation := kinematics.Quaternion{W: deck.Qw, X: deck.Qx, Y: deck.Qy, Z: deck.Qz}
-
-			commands = append(commands, Command{"move", kinematics.Pose{Position: kinematics.Position{X: wellOffsetX, Y: wellOffsetY, Z: wellTop}, Rotation: rotation}, 0})
-			commands = append(commands, Command{"move", kinematics.Pose{Position: kinematics.Position{X: wellOffsetX, Y: wellOffsetY, Z: wellBottom}, Rotation: rotation}, 0})
-			commands = append(commands, Command{"move", kinematics.Pose{Position: kinematics.Position{X: wellOffsetX, Y: wellOffsetY, Z: wellTop}, Rotation: rotation}, 0})
-		default:
-			return fmt.Errorf("Command not found. Only valid commands are `move, wait, movexyz`, got: %s", command)
-		}
-	}
-	// Exit our transaction
-	err = tx.Rollback()
-	if err != nil {
-		return err
+// GetPlacedLabware gets the version of the labware of a placement.
+func GetPlacedLabware(tx *sqlx.Tx, placement Placement) (Labware, error) {
+	if placement.LabwareVersion != 0 {
+		return GetLabwareVersion(tx, placement.LabwareName, placement.LabwareVersion)
 	}
+	return GetLabware(tx, placement.LabwareName)
+}
 
-	// Now execute the commands
-	err = executeProtocolWithCache(arm, commands)
-	if err != nil {
-		return err
-	}
-	return nil
+// CommandAspirate draws liquid from a well into the pipette. Volume is in µL
+// and FlowRate in µL/s.
+type CommandAspirate struct {
+	Placement
+	Address         string  `json:"address"`
+	Volume          float64 `json:"volume"`
+	FlowRate        float64 `json:"flow_rate"`
+	DepthFromBottom float64 `json:"depth_from_bottom"`
 }
 
-func executeProtocolWithCache(arm ar3.Arm, commands []Command) error {
-	var err error
-	for _, command := range commands {
-		if command.Command == "move" {
-			err = arm.Move(25, 10, 10, 10, 10, command.Pose)
-			if err != nil {
-				return err
-			}
-		} else {
-			err = arm.Wait(command.WaitTime)
-			if err != nil {
-				return err
-			}
-		}
-	}
-	return nil
+func (c CommandAspirate) Command() string { return "aspirate" }
+
+// CommandDispense expels liquid from the pipette into a well. Volume is in µL
+// and FlowRate in µL/s.
+type CommandDispense struct {
+	Placement
+	Address         string  `json:"address"`
+	Volume          float64 `json:"volume"`
+	FlowRate        float64 `json:"flow_rate"`
+	DepthFromBottom float64 `json:"depth_from_bottom"`
 }
 
-/******************************************************************************
+func (c CommandDispense) Command() string { return "dispense" }
 
-                                Defaults
+// CommandPickUpTip picks up a tip from a tip rack. If Address is empty, the
+// next available tip of the rack is used.
+type CommandPickUpTip struct {
+	Placement
+	Address string `json:"address"`
+}
 
-******************************************************************************/
+func (c CommandPickUpTip) Command() string { return "pick_up_tip" }
 
-type OpentronsParameters struct {
-	LoadName string `json:"loadName"`
+// CommandDropTip drops the tip of the pipette into a well, such as a trash
+// or a tip rack. If Address is empty, the first well of the labware is used.
+type CommandDropTip struct {
+	Placement
+	Address string `json:"address"`
 }
 
-type OpentronsDimensions struct {
-	ZDimension float64 `json:"zDimension"`
+func (c CommandDropTip) Command() string { return "drop_tip" }
+
+// CommandMix mixes the liquid in a well by aspirating and dispensing Volume
+// µL Repetitions times.
+type CommandMix struct {
+	Placement
+	Address         string  `json:"address"`
+	Volume          float64 `json:"volume"`
+	Repetitions     int     `json:"repetitions"`
+	FlowRate        float64 `json:"flow_rate"`
+	DepthFromBottom float64 `json:"depth_from_bottom"`
 }
 
-type OpentronsLabware struct {
-	Dimensions OpentronsDimensions `json:"dimensions"`
-	Parameters OpentronsParameters `json:"parameters"`
-	Wells      map[string]Well     `json:"wells"`
+func (c CommandMix) Command() string { return "mix" }
+
+// CommandBlowOut expels everything left in the pipette, including residual
+// liquid, at the top of a well.
+type CommandBlowOut struct {
+	Placement
+	Address string `json:"address"`
+}
+
+func (c CommandBlowOut) Command() string { return "blow_out" }
+
+// CommandTouchTip touches the tip against the wall of a well, on 4 sides, to
+// remove droplets. Radius is the fraction of the well radius, or half width
+// of rectangular wells, to move out to, and defaults to 1. DepthFromTop is
+// how far below the top of the well the wall is touched, in mm, and defaults
+// to 1.
+type CommandTouchTip struct {
+	Placement
+	Address      string  `json:"address"`
+	Radius       float64 `json:"radius"`
+	DepthFromTop float64 `json:"depth_from_top"`
+}
+
+func (c CommandTouchTip) Command() string { return "touch_tip" }
+
+// CommandAirGap aspirates Volume µL of air where the pipette is, such as to
+// keep liquid from dripping out of the tip between aspirations.
+type CommandAirGap struct {
+	Volume   float64 `json:"volume"`
+	FlowRate float64 `json:"flow_rate"`
+}
+
+func (c CommandAirGap) Command() string { return "air_gap" }
+
+// CommandWait holds the arm still for WaitTime milliseconds.
+type CommandWait struct {
+	WaitTime int `json:"wait_time"`
+}
+
+func (c CommandWait) Command() string { return "wait" }
+
+// CommandPause pauses the run until an operator resumes it, showing them
+// Message, such as an instruction to swap a plate.
+type CommandPause struct {
+	Message string `json:"message"`
+}
+
+func (c CommandPause) Command() string { return "pause" }
+
+// commandInputs contains the zero value of every CommandInput that can be
+// decoded from a protocol. A step is matched to its CommandInput by comparing
+// the step's "command" field with CommandInput.Command().
+var commandInputs = []CommandInput{
+	CommandXyz{},
+	CommandMove{},
+	CommandAspirate{},
+	CommandDispense{},
+	CommandMix{},
+	CommandBlowOut{},
+	CommandTouchTip{},
+	CommandAirGap{},
+	CommandPickUpTip{},
+	CommandDropTip{},
+	CommandWait{},
+	CommandPause{},
+	CommandTransfer{},
+	CommandDistribute{},
+	CommandConsolidate{},
+}
+
+// validCommands returns the names of all decodable commands.
+func validCommands() string {
+	var names []string
+	for _, commandInput := range commandInputs {
+		names = append(names, commandInput.Command())
+	}
+	return strings.Join(names, ", ")
+}
+
+// DecodeProtocol decodes a JSON list of steps into CommandInputs. Each step is
+// an object with a "command" field naming the CommandInput, alongside the
+// fields of that CommandInput. Unknown commands and unknown fields are
+// rejected, with the index of the offending step in the error.
+func DecodeProtocol(data []byte) ([]CommandInput, error) {
+	var steps []json.RawMessage
+	err := json.Unmarshal(data, &steps)
+	if err != nil {
+		return nil, err
+	}
+	protocol := make([]CommandInput, 0, len(steps))
+	for i, step := range steps {
+		command, err := decodeCommand(step)
+		if err != nil {
+			return nil, fmt.Errorf("step %d: %s", i, err)
+		}
+		protocol = append(protocol, command)
+	}
+	return protocol, nil
+}
+
+func decodeCommand(step json.RawMessage) (CommandInput, error) {
+	var fields map[string]json.RawMessage
+	err := json.Unmarshal(step, &fields)
+	if err != nil {
+		return nil, err
+	}
+	if fields == nil {
+		return nil, fmt.Errorf("Step must be an object")
+	}
+	rawName, ok := fields["command"]
+	if !ok {
+		return nil, fmt.Errorf("Missing `command` field")
+	}
+	var name string
+	err = json.Unmarshal(rawName, &name)
+	if err != nil {
+		return nil, fmt.Errorf("`command` must be a string: %s", err)
+	}
+	delete(fields, "command")
+
+	for _, commandInput := range commandInputs {
+		if commandInput.Command() != name {
+			continue
+		}
+		// Re-encode the remaining fields so unknown fields can be rejected
+		body, err := json.Marshal(fields)
+		if err != nil {
+			return nil, err
+		}
+		decoder := json.NewDecoder(bytes.NewReader(body))
+		decoder.DisallowUnknownFields()
+		command := reflect.New(reflect.TypeOf(commandInput))
+		err = decoder.Decode(command.Interface())
+		if err != nil {
+			return nil, fmt.Errorf("Invalid `%s` command: %s", name, err)
+		}
+		return command.Elem().Interface().(CommandInput), nil
+	}
+	return nil, fmt.Errorf("Command not found. Only valid commands are `%s`, got: %s", validCommands(), name)
+}
+
+// EncodeProtocol encodes CommandInputs into the JSON format read by
+// DecodeProtocol.
+func EncodeProtocol(protocol []CommandInput) ([]byte, error) {
+	steps := make([]map[string]json.RawMessage, 0, len(protocol))
+	for _, command := range protocol {
+		body, err := json.Marshal(command)
+		if err != nil {
+			return nil, err
+		}
+		var fields map[string]json.RawMessage
+		err = json.Unmarshal(body, &fields)
+		if err != nil {
+			return nil, err
+		}
+		name, err := json.Marshal(command.Command())
+		if err != nil {
+			return nil, err
+		}
+		fields["command"] = name
+		steps = append(steps, fields)
+	}
+	return json.Marshal(steps)
+}
+
+// Command is a single compiled action of the arm or pipette. Step is the index
+// of the protocol step that the Command was compiled from, and Target names
+// the well the Command is moving to, if any, as deck/location/labware/address.
+type Command struct {
+	Command  string          `json:"command"`
+	Pose     kinematics.Pose `json:"pose"`
+	WaitTime int             `json:"wait_time"` // Milliseconds
+	Volume   float64         `json:"volume"`    // µL
+	FlowRate float64         `json:"flow_rate"` // µL/s
+	Step     int             `json:"step"`
+	Target   string          `json:"target,omitempty"`
+	Tip      *Tip            `json:"tip,omitempty"`     // Tip picked up by pick_up_tip
+	Message  string          `json:"message,omitempty"` // Operator message of pause
+
+	// Moves to wells are annotated for OptimizeCommands
+	placement Placement
+	retract   bool    // Moving above the labware, clear of it
+	top       float64 // Top of the well being retracted from
+	travel    float64 // Travel height of the deck, if set
+}
+
+// SimulateProtocol compiles and optimizes a protocol without running it,
+// returning the Commands the arm would execute. The protocol is checked to be
+// reachable from the arm's ready position.
+func SimulateProtocol(db *sqlx.DB, pipette Pipette, protocol []CommandInput, options OptimizeOptions) ([]Command, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	commands, err := CompileProtocol(tx, pipette, protocol)
+	if err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+	commands = OptimizeCommands(commands, options)
+	err = tx.Rollback()
+	if err != nil {
+		return nil, err
+	}
+	err = CheckReachability(commands, readyJoints)
+	if err != nil {
+		return nil, err
+	}
+	return commands, nil
+}
+
+// UnreachableCommand is a compiled Command that the arm cannot reach.
+type UnreachableCommand struct {
+	Index   int     `json:"index"`
+	Command Command `json:"command"`
+	Reason  string  `json:"reason"`
+}
+
+// UnreachableError is returned for protocols that move the arm to poses it
+// cannot reach.
+type UnreachableError struct {
+	Commands []UnreachableCommand
+}
+
+func (e UnreachableError) Error() string {
+	var lines []string
+	for _, unreachable := range e.Commands {
+		line := fmt.Sprintf("step %d, command %d", unreachable.Command.Step, unreachable.Index)
+		if unreachable.Command.Target != "" {
+			line += fmt.Sprintf(" (%s)", unreachable.Command.Target)
+		}
+		lines = append(lines, line+": "+unreachable.Reason)
+	}
+	return fmt.Sprintf("Protocol has %d unreachable commands:\n%s", len(e.Commands), strings.Join(lines, "\n"))
+}
+
+// CheckReachability checks that every move of compiled Commands has an
+// inverse kinematics solution within the joint limits of the arm, starting
+// with the arm at the given joint angles. Each move is tried on a mock arm,
+// which solves and limits moves the same way as the real arm.
+func CheckReachability(commands []Command, joints [7]float64) error {
+	arm := ar3.ConnectMock()
+	p := DefaultMoveParameters
+	err := arm.MoveJointRadians(p.Speed, p.AccDur, p.AccSpd, p.DccDur, p.DccSpd, joints[0], joints[1], joints[2], joints[3], joints[4], joints[5], joints[6])
+	if err != nil {
+		return err
+	}
+	var unreachable []UnreachableCommand
+	for i, command := range commands {
+		if command.Command != "move" {
+			continue
+		}
+		// Failed moves leave the mock arm where it was, so later moves are
+		// still checked from a real position.
+		err = arm.Move(p.Speed, p.AccDur, p.AccSpd, p.DccDur, p.DccSpd, command.Pose)
+		if err != nil {
+			unreachable = append(unreachable, UnreachableCommand{Index: i, Command: command, Reason: err.Error()})
+		}
+	}
+	if len(unreachable) > 0 {
+		return UnreachableError{unreachable}
+	}
+	return nil
+}
+
+// CompileProtocol resolves the decks, locations and labwares referenced by a
+// protocol into the Commands that are sent to the arm and pipette. The
+// protocol starts from a pipette without a tip and empty, since the pipette
+// may be in use by a run. Runner.Start compiles from its current state.
+func CompileProtocol(tx *sqlx.Tx, pipette Pipette, protocol []CommandInput) ([]Command, error) {
+	return compileProtocol(tx, pipette, protocol, false, 0)
+}
+
+// compileProtocol compiles a protocol that starts with the pipette holding a
+// tip or not, and a volume in µL.
+func compileProtocol(tx *sqlx.Tx, pipette Pipette, protocol []CommandInput, hasTip bool, volume float64) ([]Command, error) {
+	c := compiler{tx: tx, pipette: pipette, volume: volume, hasTip: hasTip}
+	for i, step := range protocol {
+		c.step = i
+		err := c.compile(step)
+		if err != nil {
+			return nil, fmt.Errorf("step %d: %s", i, err)
+		}
+	}
+	return c.commands, nil
+}
+
+// compiler holds the state of a protocol while it is being compiled.
+type compiler struct {
+	tx       *sqlx.Tx
+	pipette  Pipette
+	step     int
+	volume   float64 // Volume held by the pipette, in µL
+	hasTip   bool
+	usedTips map[Placement]map[string]bool
+	commands []Command
+}
+
+func (c *compiler) compile(step CommandInput) error {
+	// Macros are compiled as the commands they expand to
+	if macro, ok := step.(Macro); ok {
+		steps, err := macro.Expand(c.pipette)
+		if err != nil {
+			return err
+		}
+		for _, step := range steps {
+			err = c.compile(step)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// Run each different possible command
+	command := step.Command()
+	switch command {
+	case "movexyz":
+		var movexyz CommandXyz
+		movexyz = step.(CommandXyz)
+
+		// Move arm to XYZ position
+		c.move(kinematics.Pose{Position: kinematics.Position{X: movexyz.X, Y: movexyz.Y, Z: movexyz.Z}, Rotation: kinematics.Quaternion{W: movexyz.Qw, X: movexyz.Qx, Y: movexyz.Qy, Z: movexyz.Qz}}, "")
+	case "move":
+		var move CommandMove
+		move = step.(CommandMove)
+
+		well, err := c.resolveWell(Placement{Deck: move.Deck, Location: move.Location, LabwareName: move.LabwareName, LabwareVersion: move.LabwareVersion}, move.Address)
+		if err != nil {
+			return err
+		}
+		// Move above the well, then into it
+		c.moveInto(well, move.DepthFromBottom)
+		c.moveAbove(well)
+	case "aspirate":
+		var aspirate CommandAspirate
+		aspirate = step.(CommandAspirate)
+		if aspirate.Volume <= 0 {
+			return fmt.Errorf("Volume must be positive")
+		}
+		if !c.hasTip {
+			return fmt.Errorf("Pipette has no tip to aspirate with")
+		}
+		if c.volume+aspirate.Volume > c.pipette.MaxVolume()+volumeTolerance {
+			return fmt.Errorf("Aspirating %gµL would exceed the pipette's max volume of %gµL", aspirate.Volume, c.pipette.MaxVolume())
+		}
+
+		well, err := c.resolveWell(aspirate.Placement, aspirate.Address)
+		if err != nil {
+			return err
+		}
+		c.moveInto(well, aspirate.DepthFromBottom)
+		c.plunger("aspirate", aspirate.Volume, aspirate.FlowRate, well.Name)
+		c.moveAbove(well)
+		c.volume += aspirate.Volume
+	case "dispense":
+		var dispense CommandDispense
+		dispense = step.(CommandDispense)
+		if dispense.Volume <= 0 {
+			return fmt.Errorf("Volume must be positive")
+		}
+		if !c.hasTip {
+			return fmt.Errorf("Pipette has no tip to dispense from")
+		}
+		if dispense.Volume > c.volume+volumeTolerance {
+			return fmt.Errorf("Cannot dispense %gµL when the pipette holds %gµL", dispense.Volume, c.volume)
+		}
+
+		well, err := c.resolveWell(dispense.Placement, dispense.Address)
+		if err != nil {
+			return err
+		}
+		c.moveInto(well, dispense.DepthFromBottom)
+		c.plunger("dispense", dispense.Volume, dispense.FlowRate, well.Name)
+		c.moveAbove(well)
+		c.volume = math.Max(c.volume-dispense.Volume, 0)
+	case "mix":
+		var mix CommandMix
+		mix = step.(CommandMix)
+		if mix.Volume <= 0 || mix.Repetitions <= 0 {
+			return fmt.Errorf("Volume and repetitions must be positive")
+		}
+		if !c.hasTip {
+			return fmt.Errorf("Pipette has no tip to mix with")
+		}
+		if c.volume+mix.Volume > c.pipette.MaxVolume()+volumeTolerance {
+			return fmt.Errorf("Mixing %gµL would exceed the pipette's max volume of %gµL", mix.Volume, c.pipette.MaxVolume())
+		}
+
+		well, err := c.resolveWell(mix.Placement, mix.Address)
+		if err != nil {
+			return err
+		}
+		c.moveInto(well, mix.DepthFromBottom)
+		for i := 0; i < mix.Repetitions; i++ {
+			c.plunger("aspirate", mix.Volume, mix.FlowRate, well.Name)
+			c.plunger("dispense", mix.Volume, mix.FlowRate, well.Name)
+		}
+		c.moveAbove(well)
+	case "blow_out":
+		var blowOut CommandBlowOut
+		blowOut = step.(CommandBlowOut)
+		if !c.hasTip {
+			return fmt.Errorf("Pipette has no tip to blow out")
+		}
+
+		well, err := c.resolveWell(blowOut.Placement, blowOut.Address)
+		if err != nil {
+			return err
+		}
+		c.moveAbove(well)
+		c.moveTo(well, well.Top())
+		c.commands = append(c.commands, Command{Command: "blow_out", Step: c.step, Target: well.Name})
+		c.moveAbove(well)
+		c.volume = 0
+	case "touch_tip":
+		var touchTip CommandTouchTip
+		touchTip = step.(CommandTouchTip)
+		if !c.hasTip {
+			return fmt.Errorf("Pipette has no tip to touch")
+		}
+		radius, depth := touchTip.Radius, touchTip.DepthFromTop
+		if radius == 0 {
+			radius = 1
+		}
+		if depth == 0 {
+			depth = 1
+		}
+		if radius < 0 || radius > 1 || depth < 0 {
+			return fmt.Errorf("Radius must be between 0 and 1, and depth from top must not be negative")
+		}
+
+		well, err := c.resolveWell(touchTip.Placement, touchTip.Address)
+		if err != nil {
+			return err
+		}
+		// Rectangular wells are touched at the middle of each wall
+		offsetX, offsetY := well.Well.Diameter/2, well.Well.Diameter/2
+		if well.Well.Shape == "rectangular" {
+			offsetX, offsetY = well.Well.XDimension/2, well.Well.YDimension/2
+		}
+		if offsetX <= 0 || offsetY <= 0 {
+			return fmt.Errorf("Well %s has no walls to touch", touchTip.Address)
+		}
+		if depth > well.Well.Depth {
+			return fmt.Errorf("Depth from top is deeper than the well")
+		}
+		z := well.Top() - depth
+		offsetX, offsetY = radius*offsetX, radius*offsetY
+		c.moveAbove(well)
+		c.moveTo(well, z)
+		// Touch the walls on the +x, -x, +y and -y sides of the well center
+		for _, side := range [][2]float64{{offsetX, 0}, {-offsetX, 0}, {0, offsetY}, {0, -offsetY}} {
+			c.move(kinematics.Pose{Position: kinematics.Position{X: well.X + side[0], Y: well.Y + side[1], Z: z}, Rotation: well.Rotation}, well.Name)
+		}
+		c.moveTo(well, z)
+		c.moveAbove(well)
+	case "air_gap":
+		var airGap CommandAirGap
+		airGap = step.(CommandAirGap)
+		if airGap.Volume <= 0 {
+			return fmt.Errorf("Volume must be positive")
+		}
+		if !c.hasTip {
+			return fmt.Errorf("Pipette has no tip to air gap")
+		}
+		if c.volume+airGap.Volume > c.pipette.MaxVolume()+volumeTolerance {
+			return fmt.Errorf("Air gap of %gµL would exceed the pipette's max volume of %gµL", airGap.Volume, c.pipette.MaxVolume())
+		}
+		c.plunger("air_gap", airGap.Volume, airGap.FlowRate, "")
+		c.volume += airGap.Volume
+	case "pick_up_tip":
+		var pickUpTip CommandPickUpTip
+		pickUpTip = step.(CommandPickUpTip)
+		if c.hasTip {
+			return fmt.Errorf("Pipette already has a tip")
+		}
+
+		address, err := c.nextTip(pickUpTip.Placement, pickUpTip.Address)
+		if err != nil {
+			return err
+		}
+		well, err := c.resolveWell(pickUpTip.Placement, address)
+		if err != nil {
+			return err
+		}
+		// Press onto the top of the tip
+		c.moveAbove(well)
+		c.moveTo(well, well.Top())
+		c.commands = append(c.commands, Command{Command: "pick_up_tip", Step: c.step, Target: well.Name, Tip: &Tip{Placement: well.Placement, Address: address}})
+		c.moveAbove(well)
+		c.usedTips[pickUpTip.Placement.tipRack()][address] = true
+		c.hasTip = true
+	case "drop_tip":
+		var dropTip CommandDropTip
+		dropTip = step.(CommandDropTip)
+		if !c.hasTip {
+			return fmt.Errorf("Pipette has no tip to drop")
+		}
+
+		address := dropTip.Address
+		if address == "" {
+			labware, err := GetPlacedLabware(c.tx, dropTip.Placement)
+			if err != nil {
+				return err
+			}
+			if len(labware.Wells) == 0 {
+				return fmt.Errorf("Labware has no wells")
+			}
+			address = orderedWells(labware)[0].Address
+		}
+		well, err := c.resolveWell(dropTip.Placement, address)
+		if err != nil {
+			return err
+		}
+		c.moveAbove(well)
+		c.moveTo(well, well.Top())
+		c.commands = append(c.commands, Command{Command: "drop_tip", Step: c.step, Target: well.Name})
+		c.moveAbove(well)
+		c.volume = 0
+		c.hasTip = false
+	case "wait":
+		var wait CommandWait
+		wait = step.(CommandWait)
+		if wait.WaitTime < 0 {
+			return fmt.Errorf("Wait time must not be negative")
+		}
+		c.commands = append(c.commands, Command{Command: "wait", WaitTime: wait.WaitTime, Step: c.step})
+	case "pause":
+		var pause CommandPause
+		pause = step.(CommandPause)
+		c.commands = append(c.commands, Command{Command: "pause", Message: pause.Message, Step: c.step})
+	default:
+		return fmt.Errorf("Command not found. Only valid commands are `%s`, got: %s", validCommands(), command)
+	}
+	return nil
+}
+
+// nextTip checks that a tip of a tip rack is available, or finds the next
+// available tip if address is empty. Tips used by earlier steps of the
+// protocol are unavailable.
+func (c *compiler) nextTip(placement Placement, address string) (string, error) {
+	if c.usedTips == nil {
+		c.usedTips = make(map[Placement]map[string]bool)
+	}
+	used, ok := c.usedTips[placement.tipRack()]
+	if !ok {
+		tipRack, err := GetTipRack(c.tx, placement.Deck, placement.Location)
+		if err != nil {
+			return "", err
+		}
+		used = make(map[string]bool)
+		for _, usedAddress := range tipRack.Used {
+			used[usedAddress] = true
+		}
+		c.usedTips[placement.tipRack()] = used
+	}
+
+	if address != "" {
+		if used[address] {
+			return "", fmt.Errorf("Tip %s of tip rack %s/%s is already used", address, placement.Deck, placement.Location)
+		}
+		return address, nil
+	}
+	labware, err := GetPlacedLabware(c.tx, placement)
+	if err != nil {
+		return "", err
+	}
+	for _, well := range orderedWells(labware) {
+		if !used[well.Address] {
+			return well.Address, nil
+		}
+	}
+	return "", fmt.Errorf("No tips left in tip rack %s/%s", placement.Deck, placement.Location)
+}
+
+// wellTarget is a well resolved to positions in the frame of the arm.
+type wellTarget struct {
+	Name     string // deck/location/labware/address
+	Labware  Labware
+	Well     Well
+	X        float64
+	Y        float64
+	Bottom   float64 // Z of the bottom of the well
+	Above    float64 // Z the well is approached from, above the labware
+	Travel   float64 // Z that clears every labware of the deck, if set
+	Rotation kinematics.Quaternion
+	Placement
+}
+
+// Top returns the Z of the top of the well.
+func (w wellTarget) Top() float64 {
+	return w.Bottom + w.Well.Depth
+}
+
+// resolveWell finds the position of a well of a placed labware, using the
+// calibration of the deck.
+func (c *compiler) resolveWell(placement Placement, address string) (wellTarget, error) {
+	var target wellTarget
+
+	// Get deck calibration
+	deck, err := GetDeck(c.tx, placement.Deck)
+	if err != nil {
+		return target, err
+	}
+	if !deck.Calibrated {
+		return target, fmt.Errorf("Please calibrate the deck")
+	}
+	locations := make(map[string]Location)
+	for _, location := range deck.Locations {
+		locations[location.Name] = location
+	}
+	if _, ok := locations[placement.Location]; !ok {
+		return target, fmt.Errorf("Location not in deck")
+	}
+	targetLocation := locations[placement.Location]
+
+	// Get labware, recording the version that is used
+	labware, err := GetPlacedLabware(c.tx, placement)
+	if err != nil {
+		return target, err
+	}
+	wells := make(map[string]Well)
+	for _, well := range labware.Wells {
+		wells[well.Address] = well
+	}
+	if _, ok := wells[address]; !ok {
+		return target, fmt.Errorf("Well not in labware")
+	}
+	targetWell := wells[address]
+
+	placement.LabwareVersion = labware.Version
+
+	locationOffsetX := deck.X + targetLocation.X
+	locationOffsetY := deck.Y + targetLocation.Y
+	locationOffsetZ := deck.Z + targetLocation.Z
+	target = wellTarget{
+		Name:      fmt.Sprintf("%s/%s/%s/%s", placement.Deck, placement.Location, placement.LabwareName, address),
+		Labware:   labware,
+		Well:      targetWell,
+		X:         locationOffsetX + targetWell.X,
+		Y:         locationOffsetY + targetWell.Y,
+		Bottom:    locationOffsetZ + targetWell.Z,
+		Above:     locationOffsetZ + targetWell.Z + labware.ZDimension + 5,
+		Rotation:  kinematics.Quaternion{W: deck.Qw, X: deck.Qx, Y: deck.Qy, Z: deck.Qz},
+		Placement: placement,
+	}
+	if deck.TravelHeight > 0 {
+		target.Travel = deck.Z + deck.TravelHeight
+	}
+	return target, nil
+}
+
+func (c *compiler) move(pose kinematics.Pose, target string) {
+	c.commands = append(c.commands, Command{Command: "move", Pose: pose, Step: c.step, Target: target})
+}
+
+func (c *compiler) moveTo(well wellTarget, z float64) {
+	c.move(kinematics.Pose{Position: kinematics.Position{X: well.X, Y: well.Y, Z: z}, Rotation: well.Rotation}, well.Name)
+	c.commands[len(c.commands)-1].placement = well.Placement
+}
+
+// moveAbove moves the arm above a well, clear of its labware.
+func (c *compiler) moveAbove(well wellTarget) {
+	c.moveTo(well, well.Above)
+	c.commands[len(c.commands)-1].retract = true
+	c.commands[len(c.commands)-1].top = well.Top()
+	c.commands[len(c.commands)-1].travel = well.Travel
+}
+
+// moveInto moves the arm above a well, then down into it.
+func (c *compiler) moveInto(well wellTarget, depthFromBottom float64) {
+	c.moveAbove(well)
+	c.moveTo(well, well.Bottom+depthFromBottom)
+}
+
+// plunger actuates the pipette plunger, using DefaultFlowRate if flowRate is
+// not set.
+func (c *compiler) plunger(command string, volume float64, flowRate float64, target string) {
+	if flowRate <= 0 {
+		flowRate = DefaultFlowRate
+	}
+	c.commands = append(c.commands, Command{Command: command, Volume: volume, FlowRate: flowRate, Step: c.step, Target: target})
+}
+
+// executeCommand sends a single compiled Command to the arm or pipette.
+func executeCommand(arm ar3.Arm, pipette Pipette, command Command) error {
+	switch command.Command {
+	case "move":
+		p := DefaultMoveParameters
+		return arm.Move(p.Speed, p.AccDur, p.AccSpd, p.DccDur, p.DccSpd, command.Pose)
+	case "aspirate":
+		return pipette.Aspirate(command.Volume, command.FlowRate)
+	case "dispense":
+		return pipette.Dispense(command.Volume, command.FlowRate)
+	case "air_gap":
+		return pipette.Aspirate(command.Volume, command.FlowRate)
+	case "blow_out":
+		return pipette.BlowOut()
+	case "pick_up_tip":
+		return pipette.PickUpTip()
+	case "drop_tip":
+		return pipette.DropTip()
+	case "wait":
+		return arm.Wait(command.WaitTime)
+	case "pause":
+		// Pausing for an operator is handled by the Runner
+		return nil
+	}
+	return fmt.Errorf("Unknown command %s", command.Command)
+}
+
+/******************************************************************************
+
+                                Pipette
+
+******************************************************************************/
+
+// DefaultFlowRate is the flow rate in µL/s used by liquid handling commands
+// that do not set one.
+var DefaultFlowRate = 50.0
+
+// volumeTolerance absorbs rounding errors when volumes split into several
+// parts are added back up, in µL.
+const volumeTolerance = 1e-9
+
+// Pipette is the generic interface for a pipette mounted on the arm. Volumes
+// are in µL and flow rates in µL/s.
+type Pipette interface {
+	MaxVolume() float64
+	Volume() float64
+	HasTip() bool
+
+	Aspirate(volume, flowRate float64) error
+	Dispense(volume, flowRate float64) error
+	BlowOut() error
+	PickUpTip() error
+	DropTip() error
+}
+
+// PipetteMock simulates a Pipette for testing purposes.
+type PipetteMock struct {
+	maxVolume float64
+	volume    float64
+	hasTip    bool
+}
+
+// ConnectMockPipette connects to a mock Pipette with a max volume in µL.
+func ConnectMockPipette(maxVolume float64) Pipette {
+	return &PipetteMock{maxVolume: maxVolume}
+}
+
+// MaxVolume returns the largest volume the pipette can hold.
+func (p *PipetteMock) MaxVolume() float64 { return p.maxVolume }
+
+// Volume returns the volume currently held by the pipette.
+func (p *PipetteMock) Volume() float64 { return p.volume }
+
+// HasTip returns whether a tip is attached to the pipette.
+func (p *PipetteMock) HasTip() bool { return p.hasTip }
+
+// Aspirate simulates drawing liquid into the pipette.
+func (p *PipetteMock) Aspirate(volume, flowRate float64) error {
+	if volume <= 0 || flowRate <= 0 {
+		return fmt.Errorf("Volume and flow rate must be positive. Got %gµL at %gµL/s", volume, flowRate)
+	}
+	if p.volume+volume > p.maxVolume+volumeTolerance {
+		return fmt.Errorf("Aspirating %gµL would exceed max volume of %gµL", volume, p.maxVolume)
+	}
+	p.volume += volume
+	return nil
+}
+
+// Dispense simulates expelling liquid from the pipette.
+func (p *PipetteMock) Dispense(volume, flowRate float64) error {
+	if volume <= 0 || flowRate <= 0 {
+		return fmt.Errorf("Volume and flow rate must be positive. Got %gµL at %gµL/s", volume, flowRate)
+	}
+	if volume > p.volume+volumeTolerance {
+		return fmt.Errorf("Cannot dispense %gµL when holding %gµL", volume, p.volume)
+	}
+	p.volume = math.Max(p.volume-volume, 0)
+	return nil
+}
+
+// BlowOut simulates expelling everything left in the pipette.
+func (p *PipetteMock) BlowOut() error {
+	p.volume = 0
+	return nil
+}
+
+// PickUpTip simulates attaching a tip to the pipette.
+func (p *PipetteMock) PickUpTip() error {
+	if p.hasTip {
+		return fmt.Errorf("Pipette already has a tip")
+	}
+	p.hasTip = true
+	return nil
+}
+
+// DropTip simulates ejecting the tip of the pipette, along with any liquid
+// left in it.
+func (p *PipetteMock) DropTip() error {
+	if !p.hasTip {
+		return fmt.Errorf("Pipette has no tip to drop")
+	}
+	p.hasTip = false
+	p.volume = 0
+	return nil
+}
+
+/******************************************************************************
+
+                                Tips
+
+******************************************************************************/
+
+// Tip is a single tip of a tip rack placed on a deck.
+type Tip struct {
+	Placement
+	Address string `json:"address"`
+}
+
+// TipRack is the tip inventory of a location of a deck. Tips are available
+// unless their address is Used.
+type TipRack struct {
+	Deck     string   `json:"deck"`
+	Location string   `json:"location"`
+	Used     []string `json:"used"`
+}
+
+// TipRackRefill lists the tips that were put back into a tip rack.
+type TipRackRefill struct {
+	Addresses []string `json:"addresses"`
+}
+
+func GetTipRack(tx *sqlx.Tx, deck string, location string) (TipRack, error) {
+	tipRack := TipRack{Deck: deck, Location: location, Used: []string{}}
+	err := tx.Select(&tipRack.Used, "SELECT address FROM used_tip WHERE deck = ? AND location = ? ORDER BY address", deck, location)
+	if err != nil {
+		return tipRack, err
+	}
+	return tipRack, nil
+}
+
+// UseTip marks a tip as used, so it is skipped by later protocols.
+func UseTip(tx *sqlx.Tx, tip Tip) error {
+	_, err := tx.Exec("INSERT OR REPLACE INTO used_tip(deck, location, labware, address) VALUES (?, ?, ?, ?)", tip.Deck, tip.Location, tip.LabwareName, tip.Address)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// ResetTipRack marks every tip of a tip rack as available, such as after
+// placing a new rack.
+func ResetTipRack(tx *sqlx.Tx, deck string, location string) error {
+	_, err := tx.Exec("DELETE FROM used_tip WHERE deck = ? AND location = ?", deck, location)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// RefillTipRack marks some tips of a tip rack as available, such as after
+// partially refilling it.
+func RefillTipRack(tx *sqlx.Tx, deck string, location string, addresses []string) error {
+	for _, address := range addresses {
+		_, err := tx.Exec("DELETE FROM used_tip WHERE deck = ? AND location = ? AND address = ?", deck, location, address)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// orderedWells returns the wells of a labware in the order of the labware,
+// or column by column if it has no ordering.
+func orderedWells(labware Labware) []Well {
+	if len(labware.Ordering) == 0 {
+		return wellOrder(labware.Wells)
+	}
+	wells := wellsByAddress(labware.Wells)
+	var ordered []Well
+	for _, address := range orderedAddresses(labware.Ordering, wells) {
+		ordered = append(ordered, wells[address])
+	}
+	return ordered
+}
+
+// wellOrder sorts wells column by column, as A1, B1, ..., A2, B2, which is
+// the order tips are picked up from a tip rack.
+func wellOrder(wells []Well) []Well {
+	ordered := make([]Well, len(wells))
+	copy(ordered, wells)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		rowI, columnI := splitAddress(ordered[i].Address)
+		rowJ, columnJ := splitAddress(ordered[j].Address)
+		if columnI != columnJ {
+			return columnI < columnJ
+		}
+		if len(rowI) != len(rowJ) {
+			return len(rowI) < len(rowJ)
+		}
+		return rowI < rowJ
+	})
+	return ordered
+}
+
+// splitAddress splits a well address such as B12 into its row and column.
+func splitAddress(address string) (string, int) {
+	split := strings.IndexAny(address, "0123456789")
+	if split < 0 {
+		return address, 0
+	}
+	column, err := strconv.Atoi(address[split:])
+	if err != nil {
+		return address, 0
+	}
+	return address[:split], column
+}
+
+/******************************************************************************
+
+                                Macros
+
+******************************************************************************/
+
+// Macro is a CommandInput that expands into simpler CommandInputs when a
+// protocol is compiled. All the commands a Macro expands to share its step.
+type Macro interface {
+	CommandInput
+	Expand(pipette Pipette) ([]CommandInput, error)
+}
+
+// Tip handling options of liquid handling macros.
+const (
+	NewTipAlways = "always" // A new tip for every transfer
+	NewTipOnce   = "once"   // One tip for all transfers
+	NewTipNever  = "never"  // Use the tip already on the pipette
+)
+
+// CommandTransfer moves liquid from source wells to destination wells.
+// Wells may be given as ranges, such as A1:H1. Sources and destinations are
+// paired one to one, or one to many, or many to one. Volumes holds either
+// one volume in µL for every transfer, or one per transfer. Volumes larger
+// than the pipette are split into several trips. New tips are picked from
+// TipRack and dropped into Trash, according to NewTip, which defaults to
+// once.
+type CommandTransfer struct {
+	Source           Placement `json:"source"`
+	SourceWells      []string  `json:"source_wells"`
+	Destination      Placement `json:"destination"`
+	DestinationWells []string  `json:"destination_wells"`
+	Volumes          []float64 `json:"volumes"`
+	NewTip           string    `json:"new_tip"`
+	TipRack          Placement `json:"tip_rack"`
+	Trash            Placement `json:"trash"`
+	FlowRate         float64   `json:"flow_rate"`
+	DepthFromBottom  float64   `json:"depth_from_bottom"`
+}
+
+func (c CommandTransfer) Command() string { return "transfer" }
+
+// Expand expands a transfer into tip handling, aspirate and dispense steps.
+func (c CommandTransfer) Expand(pipette Pipette) ([]CommandInput, error) {
+	sources, destinations, err := pairWells(c.SourceWells, c.DestinationWells)
+	if err != nil {
+		return nil, err
+	}
+	volumes, err := transferVolumes(c.Volumes, len(sources))
+	if err != nil {
+		return nil, err
+	}
+	newTip, err := tipHandling(c.NewTip)
+	if err != nil {
+		return nil, err
+	}
+
+	var trips [][]CommandInput
+	for i := range sources {
+		var trip []CommandInput
+		for _, volume := range splitVolume(volumes[i], pipette.MaxVolume()) {
+			trip = append(trip, CommandAspirate{Placement: c.Source, Address: sources[i], Volume: volume, FlowRate: c.FlowRate, DepthFromBottom: c.DepthFromBottom})
+			trip = append(trip, CommandDispense{Placement: c.Destination, Address: destinations[i], Volume: volume, FlowRate: c.FlowRate, DepthFromBottom: c.DepthFromBottom})
+		}
+		trips = append(trips, trip)
+	}
+	return withTips(newTip, c.TipRack, c.Trash, trips), nil
+}
+
+// CommandDistribute dispenses liquid from one source well into many
+// destination wells, filling the pipette with as many dispenses as it can
+// hold per aspiration. DisposalVolume µL extra are aspirated on each trip so
+// every dispense is accurate, and are dispensed back into the source. With
+// NewTip always, every trip uses a new tip.
+type CommandDistribute struct {
+	Source           Placement `json:"source"`
+	SourceWell       string    `json:"source_well"`
+	Destination      Placement `json:"destination"`
+	DestinationWells []string  `json:"destination_wells"`
+	Volumes          []float64 `json:"volumes"`
+	DisposalVolume   float64   `json:"disposal_volume"`
+	NewTip           string    `json:"new_tip"`
+	TipRack          Placement `json:"tip_rack"`
+	Trash            Placement `json:"trash"`
+	FlowRate         float64   `json:"flow_rate"`
+	DepthFromBottom  float64   `json:"depth_from_bottom"`
+}
+
+func (c CommandDistribute) Command() string { return "distribute" }
+
+// Expand expands a distribute into trips of one aspirate and many dispenses.
+func (c CommandDistribute) Expand(pipette Pipette) ([]CommandInput, error) {
+	destinations, err := expandWells(c.DestinationWells)
+	if err != nil {
+		return nil, err
+	}
+	if len(destinations) == 0 {
+		return nil, fmt.Errorf("Destinations must not be empty")
+	}
+	volumes, err := transferVolumes(c.Volumes, len(destinations))
+	if err != nil {
+		return nil, err
+	}
+	if c.DisposalVolume < 0 {
+		return nil, fmt.Errorf("Disposal volume must not be negative")
+	}
+	newTip, err := tipHandling(c.NewTip)
+	if err != nil {
+		return nil, err
+	}
+	groups, err := packTrips(volumes, pipette.MaxVolume()-c.DisposalVolume)
+	if err != nil {
+		return nil, err
+	}
+
+	var trips [][]CommandInput
+	for _, group := range groups {
+		aspirate := CommandAspirate{Placement: c.Source, Address: c.SourceWell, Volume: c.DisposalVolume, FlowRate: c.FlowRate, DepthFromBottom: c.DepthFromBottom}
+		var dispenses []CommandInput
+		for _, i := range group {
+			aspirate.Volume += volumes[i]
+			dispenses = append(dispenses, CommandDispense{Placement: c.Destination, Address: destinations[i], Volume: volumes[i], FlowRate: c.FlowRate, DepthFromBottom: c.DepthFromBottom})
+		}
+		trip := append([]CommandInput{aspirate}, dispenses...)
+		if c.DisposalVolume > 0 {
+			trip = append(trip, CommandDispense{Placement: c.Source, Address: c.SourceWell, Volume: c.DisposalVolume, FlowRate: c.FlowRate, DepthFromBottom: c.DepthFromBottom})
+		}
+		trips = append(trips, trip)
+	}
+	return withTips(newTip, c.TipRack, c.Trash, trips), nil
+}
+
+// CommandConsolidate pools liquid from many source wells into one
+// destination well, aspirating from as many sources as the pipette can hold
+// per dispense. With NewTip always, every trip uses a new tip.
+type CommandConsolidate struct {
+	Source          Placement `json:"source"`
+	SourceWells     []string  `json:"source_wells"`
+	Destination     Placement `json:"destination"`
+	DestinationWell string    `json:"destination_well"`
+	Volumes         []float64 `json:"volumes"`
+	NewTip          string    `json:"new_tip"`
+	TipRack         Placement `json:"tip_rack"`
+	Trash           Placement `json:"trash"`
+	FlowRate        float64   `json:"flow_rate"`
+	DepthFromBottom float64   `json:"depth_from_bottom"`
+}
+
+func (c CommandConsolidate) Command() string { return "consolidate" }
+
+// Expand expands a consolidate into trips of many aspirates and one
+// dispense.
+func (c CommandConsolidate) Expand(pipette Pipette) ([]CommandInput, error) {
+	sources, err := expandWells(c.SourceWells)
+	if err != nil {
+		return nil, err
+	}
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("Sources must not be empty")
+	}
+	volumes, err := transferVolumes(c.Volumes, len(sources))
+	if err != nil {
+		return nil, err
+	}
+	newTip, err := tipHandling(c.NewTip)
+	if err != nil {
+		return nil, err
+	}
+	groups, err := packTrips(volumes, pipette.MaxVolume())
+	if err != nil {
+		return nil, err
+	}
+
+	var trips [][]CommandInput
+	for _, group := range groups {
+		var trip []CommandInput
+		dispense := CommandDispense{Placement: c.Destination, Address: c.DestinationWell, FlowRate: c.FlowRate, DepthFromBottom: c.DepthFromBottom}
+		for _, i := range group {
+			dispense.Volume += volumes[i]
+			trip = append(trip, CommandAspirate{Placement: c.Source, Address: sources[i], Volume: volumes[i], FlowRate: c.FlowRate, DepthFromBottom: c.DepthFromBottom})
+		}
+		trips = append(trips, append(trip, dispense))
+	}
+	return withTips(newTip, c.TipRack, c.Trash, trips), nil
+}
+
+// withTips joins the trips of a macro, picking up and dropping tips around
+// them according to a NewTip option.
+func withTips(newTip string, tipRack Placement, trash Placement, trips [][]CommandInput) []CommandInput {
+	var steps []CommandInput
+	for i, trip := range trips {
+		if newTip == NewTipAlways || (newTip == NewTipOnce && i == 0) {
+			steps = append(steps, CommandPickUpTip{Placement: tipRack})
+		}
+		steps = append(steps, trip...)
+		if newTip == NewTipAlways {
+			steps = append(steps, CommandDropTip{Placement: trash})
+		}
+	}
+	if newTip == NewTipOnce {
+		steps = append(steps, CommandDropTip{Placement: trash})
+	}
+	return steps
+}
+
+// packTrips groups consecutive volumes into as few trips as possible, where
+// the volumes of each trip add up to at most capacity. Trips are returned as
+// the indexes of their volumes.
+func packTrips(volumes []float64, capacity float64) ([][]int, error) {
+	var trips [][]int
+	var trip []int
+	total := 0.0
+	for i, volume := range volumes {
+		if volume > capacity {
+			return nil, fmt.Errorf("Volume %gµL does not fit in the pipette, which can hold %gµL per trip", volume, capacity)
+		}
+		if total+volume > capacity {
+			trips = append(trips, trip)
+			trip, total = nil, 0
+		}
+		trip = append(trip, i)
+		total += volume
+	}
+	if len(trip) > 0 {
+		trips = append(trips, trip)
+	}
+	return trips, nil
+}
+
+// tipHandling validates a NewTip option, defaulting to NewTipOnce.
+func tipHandling(newTip string) (string, error) {
+	switch newTip {
+	case "":
+		return NewTipOnce, nil
+	case NewTipAlways, NewTipOnce, NewTipNever:
+		return newTip, nil
+	}
+	return "", fmt.Errorf("new_tip must be one of `%s`, `%s` or `%s`, got: %s", NewTipAlways, NewTipOnce, NewTipNever, newTip)
+}
+
+// pairWells expands source and destination well ranges, and pairs them one
+// to one, one to many or many to one.
+func pairWells(sourceWells []string, destinationWells []string) ([]string, []string, error) {
+	sources, err := expandWells(sourceWells)
+	if err != nil {
+		return nil, nil, err
+	}
+	destinations, err := expandWells(destinationWells)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch {
+	case len(sources) == 0 || len(destinations) == 0:
+		return nil, nil, fmt.Errorf("Sources and destinations must not be empty")
+	case len(sources) == len(destinations):
+		return sources, destinations, nil
+	case len(sources) == 1:
+		return repeatWell(sources[0], len(destinations)), destinations, nil
+	case len(destinations) == 1:
+		return sources, repeatWell(destinations[0], len(sources)), nil
+	}
+	return nil, nil, fmt.Errorf("Cannot pair %d sources with %d destinations", len(sources), len(destinations))
+}
+
+func repeatWell(address string, n int) []string {
+	wells := make([]string, n)
+	for i := range wells {
+		wells[i] = address
+	}
+	return wells
+}
+
+// transferVolumes gives the volume of each of n transfers.
+func transferVolumes(volumes []float64, n int) ([]float64, error) {
+	if len(volumes) == 1 {
+		all := make([]float64, n)
+		for i := range all {
+			all[i] = volumes[0]
+		}
+		volumes = all
+	}
+	if len(volumes) != n {
+		return nil, fmt.Errorf("Got %d volumes for %d transfers", len(volumes), n)
+	}
+	for _, volume := range volumes {
+		if volume <= 0 {
+			return nil, fmt.Errorf("Volumes must be positive")
+		}
+	}
+	return volumes, nil
+}
+
+// splitVolume splits a volume into the fewest equal parts that fit in the
+// pipette.
+func splitVolume(volume float64, maxVolume float64) []float64 {
+	trips := int(math.Ceil(volume / maxVolume))
+	if trips < 1 {
+		trips = 1
+	}
+	parts := make([]float64, trips)
+	for i := range parts {
+		parts[i] = volume / float64(trips)
+	}
+	return parts
+}
+
+// expandWells expands well ranges, such as A1:H1, into the addresses of the
+// wells they cover, column by column. Single addresses are kept as is.
+func expandWells(wells []string) ([]string, error) {
+	var addresses []string
+	for _, well := range wells {
+		bounds := strings.Split(well, ":")
+		if len(bounds) == 1 {
+			addresses = append(addresses, well)
+			continue
+		}
+		if len(bounds) != 2 {
+			return nil, fmt.Errorf("Invalid well range %s", well)
+		}
+		startRow, startColumn := splitAddress(bounds[0])
+		endRow, endColumn := splitAddress(bounds[1])
+		if len(startRow) != 1 || len(endRow) != 1 || startColumn == 0 || endColumn == 0 || startRow > endRow || startColumn > endColumn {
+			return nil, fmt.Errorf("Invalid well range %s", well)
+		}
+		for column := startColumn; column <= endColumn; column++ {
+			for row := startRow[0]; row <= endRow[0]; row++ {
+				addresses = append(addresses, fmt.Sprintf("%c%d", row, column))
+			}
+		}
+	}
+	return addresses, nil
+}
+
+/******************************************************************************
+
+                                Generators
+
+******************************************************************************/
+
+// SerialDilution describes a serial dilution along a row of a plate. The
+// well at StartColumn holds the stock, and must be filled with FinalVolume
+// plus one transfer volume before the protocol runs. Each of the next Steps
+// wells receives FinalVolume µL of diluent from DiluentWell, then liquid is
+// carried down the row so that every well is diluted by DilutionFactor from
+// the previous one. The extra transfer volume is removed from the last well,
+// so every well ends with FinalVolume µL.
+type SerialDilution struct {
+	Plate          Placement `json:"plate"`
+	Row            string    `json:"row"`
+	StartColumn    int       `json:"start_column"`
+	Steps          int       `json:"steps"`
+	DilutionFactor float64   `json:"dilution_factor"`
+	FinalVolume    float64   `json:"final_volume"`
+	Diluent        Placement `json:"diluent"`
+	DiluentWell    string    `json:"diluent_well"`
+	TipRack        Placement `json:"tip_rack"`
+	Trash          Placement `json:"trash"`
+	MixRepetitions int       `json:"mix_repetitions"`
+}
+
+// GenerateSerialDilution generates the protocol of a serial dilution. Row
+// defaults to A, and MixRepetitions to 3.
+func GenerateSerialDilution(dilution SerialDilution, pipette Pipette) ([]CommandInput, error) {
+	if dilution.Row == "" {
+		dilution.Row = "A"
+	}
+	if dilution.MixRepetitions == 0 {
+		dilution.MixRepetitions = 3
+	}
+	if dilution.StartColumn < 1 || dilution.Steps < 1 || dilution.MixRepetitions < 1 {
+		return nil, fmt.Errorf("Start column, steps and mix repetitions must be positive")
+	}
+	if dilution.DilutionFactor <= 1 {
+		return nil, fmt.Errorf("Dilution factor must be greater than 1")
+	}
+	if dilution.FinalVolume <= 0 {
+		return nil, fmt.Errorf("Final volume must be positive")
+	}
+
+	// Diluting by a factor F with D µL of diluent takes D/(F-1) µL of the
+	// previous well
+	transferVolume := dilution.FinalVolume / (dilution.DilutionFactor - 1)
+	mixVolume := math.Min(dilution.FinalVolume, pipette.MaxVolume()) / 2
+	wells := make([]string, dilution.Steps+1)
+	for i := range wells {
+		wells[i] = fmt.Sprintf("%s%d", dilution.Row, dilution.StartColumn+i)
+	}
+
+	protocol := []CommandInput{
+		CommandDistribute{Source: dilution.Diluent, SourceWell: dilution.DiluentWell, Destination: dilution.Plate, DestinationWells: wells[1:], Volumes: []float64{dilution.FinalVolume}, TipRack: dilution.TipRack, Trash: dilution.Trash},
+	}
+	for i := 0; i < dilution.Steps; i++ {
+		protocol = append(protocol,
+			CommandPickUpTip{Placement: dilution.TipRack},
+			CommandAspirate{Placement: dilution.Plate, Address: wells[i], Volume: transferVolume},
+			CommandDispense{Placement: dilution.Plate, Address: wells[i+1], Volume: transferVolume},
+			CommandMix{Placement: dilution.Plate, Address: wells[i+1], Volume: mixVolume, Repetitions: dilution.MixRepetitions},
+		)
+		if i == dilution.Steps-1 {
+			// Discard the extra volume of the last well with its tip
+			protocol = append(protocol, CommandAspirate{Placement: dilution.Plate, Address: wells[i+1], Volume: transferVolume})
+		}
+		protocol = append(protocol, CommandDropTip{Placement: dilution.Trash})
+	}
+	return protocol, nil
+}
+
+// CherryPick describes a hit picking protocol from a CSV with one transfer
+// per row. Columns names the CSV headers of each field, and Plates maps the
+// plate names used in the CSV to their placements on a deck. NewTip defaults
+// to always, so hits are not cross contaminated.
+type CherryPick struct {
+	CSV      string               `json:"csv"`
+	Columns  CherryPickColumns    `json:"columns"`
+	Plates   map[string]Placement `json:"plates"`
+	NewTip   string               `json:"new_tip"`
+	TipRack  Placement            `json:"tip_rack"`
+	Trash    Placement            `json:"trash"`
+	FlowRate float64              `json:"flow_rate"`
+}
+
+// CherryPickColumns are the CSV headers of the fields of a cherry pick. Empty
+// headers default to the JSON name of their field.
+type CherryPickColumns struct {
+	SourcePlate      string `json:"source_plate"`
+	SourceWell       string `json:"source_well"`
+	DestinationPlate string `json:"destination_plate"`
+	DestinationWell  string `json:"destination_well"`
+	Volume           string `json:"volume"`
+}
+
+// RowError is a problem with a row of a CSV. Row 1 is the header.
+type RowError struct {
+	Row     int    `json:"row"`
+	Message string `json:"message"`
+}
+
+// CSVError lists every invalid row of a CSV.
+type CSVError struct {
+	Rows []RowError `json:"rows"`
+}
+
+func (e CSVError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "CSV has %d invalid rows:", len(e.Rows))
+	for _, row := range e.Rows {
+		fmt.Fprintf(&b, "\nrow %d: %s", row.Row, row.Message)
+	}
+	return b.String()
+}
+
+// cherryPickRow is a valid row of a cherry pick CSV.
+type cherryPickRow struct {
+	source          string
+	sourceWell      string
+	destination     string
+	destinationWell string
+	volume          float64
+	sourceWellOrder int
+}
+
+// GenerateCherryPick generates the protocol of a cherry pick. Every row is
+// validated against the labware placed for its plates, and all invalid rows
+// are returned in a CSVError. Rows are sorted by plate and by source well,
+// and consecutive rows between the same plates are grouped into a single
+// transfer.
+func GenerateCherryPick(tx *sqlx.Tx, pick CherryPick) ([]CommandInput, error) {
+	if pick.NewTip == "" {
+		pick.NewTip = NewTipAlways
+	}
+	columns := []*string{&pick.Columns.SourcePlate, &pick.Columns.SourceWell, &pick.Columns.DestinationPlate, &pick.Columns.DestinationWell, &pick.Columns.Volume}
+	for i, name := range []string{"source_plate", "source_well", "destination_plate", "destination_well", "volume"} {
+		if *columns[i] == "" {
+			*columns[i] = name
+		}
+	}
+
+	records, err := csv.NewReader(strings.NewReader(pick.CSV)).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) < 2 {
+		return nil, fmt.Errorf("CSV must have a header and at least one row")
+	}
+	header := make(map[string]int)
+	for i, name := range records[0] {
+		header[strings.TrimSpace(name)] = i
+	}
+	indexes := make([]int, len(columns))
+	for i, column := range columns {
+		index, ok := header[*column]
+		if !ok {
+			return nil, fmt.Errorf("CSV has no column %s", *column)
+		}
+		indexes[i] = index
+	}
+
+	// Index the wells of every placed plate
+	plateWells := make(map[string]map[string]int)
+	for name, placement := range pick.Plates {
+		labware, err := GetPlacedLabware(tx, placement)
+		if err != nil {
+			return nil, fmt.Errorf("Plate %s: %s", name, err)
+		}
+		wells := make(map[string]int)
+		for i, well := range orderedWells(labware) {
+			wells[well.Address] = i
+		}
+		plateWells[name] = wells
+	}
+
+	var rows []cherryPickRow
+	var rowErrors []RowError
+	for i, record := range records[1:] {
+		rowError := func(format string, a ...interface{}) {
+			rowErrors = append(rowErrors, RowError{Row: i + 2, Message: fmt.Sprintf(format, a...)})
+		}
+		fields := make([]string, len(indexes))
+		for j, index := range indexes {
+			fields[j] = strings.TrimSpace(record[index])
+		}
+		row := cherryPickRow{source: fields[0], sourceWell: fields[1], destination: fields[2], destinationWell: fields[3]}
+
+		volume, err := strconv.ParseFloat(fields[4], 64)
+		if err != nil || volume <= 0 {
+			rowError("Volume must be a positive number, got: %s", fields[4])
+			continue
+		}
+		row.volume = volume
+		sourceWells, ok := plateWells[row.source]
+		if !ok {
+			rowError("Plate %s has no placement", row.source)
+			continue
+		}
+		destinationWells, ok := plateWells[row.destination]
+		if !ok {
+			rowError("Plate %s has no placement", row.destination)
+			continue
+		}
+		if _, ok := sourceWells[row.sourceWell]; !ok {
+			rowError("Well %s not in plate %s", row.sourceWell, row.source)
+			continue
+		}
+		if _, ok := destinationWells[row.destinationWell]; !ok {
+			rowError("Well %s not in plate %s", row.destinationWell, row.destination)
+			continue
+		}
+		row.sourceWellOrder = sourceWells[row.sourceWell]
+		rows = append(rows, row)
+	}
+	if len(rowErrors) > 0 {
+		return nil, CSVError{Rows: rowErrors}
+	}
+
+	sort.SliceStable(rows, func(i, j int) bool {
+		if rows[i].source != rows[j].source {
+			return rows[i].source < rows[j].source
+		}
+		if rows[i].destination != rows[j].destination {
+			return rows[i].destination < rows[j].destination
+		}
+		return rows[i].sourceWellOrder < rows[j].sourceWellOrder
+	})
+	var protocol []CommandInput
+	for i, row := range rows {
+		if i == 0 || row.source != rows[i-1].source || row.destination != rows[i-1].destination {
+			protocol = append(protocol, CommandTransfer{Source: pick.Plates[row.source], Destination: pick.Plates[row.destination], NewTip: pick.NewTip, TipRack: pick.TipRack, Trash: pick.Trash, FlowRate: pick.FlowRate})
+		}
+		transfer := protocol[len(protocol)-1].(CommandTransfer)
+		transfer.SourceWells = append(transfer.SourceWells, row.sourceWell)
+		transfer.DestinationWells = append(transfer.DestinationWells, row.destinationWell)
+		transfer.Volumes = append(transfer.Volumes, row.volume)
+		protocol[len(protocol)-1] = transfer
+	}
+	return protocol, nil
+}
+
+// Well naming schemes of a LabwareGrid.
+const (
+	NamingRowColumn = "row_column" // A1, B1, ..., A2: a letter per row and a number per column
+	NamingNumeric   = "numeric"    // 1, 2, 3, ...: numbered down each column
+)
+
+// LabwareGrid describes a custom labware, such as a 3D printed tube rack,
+// with wells laid out on a grid. Positions are in mm from the front left
+// corner of the labware, as in Opentrons labware definitions: A1X and A1Y
+// are the center of well A1, rows run from the back to the front every
+// RowPitch, and columns from the left to the right every ColumnPitch. ZOffset
+// is the height of the bottom of the wells.
+type LabwareGrid struct {
+	Name            string  `json:"name"`
+	Version         int     `json:"version"`
+	DisplayName     string  `json:"display_name"`
+	DisplayCategory string  `json:"display_category"`
+	Rows            int     `json:"rows"`
+	Columns         int     `json:"columns"`
+	RowPitch        float64 `json:"row_pitch"`
+	ColumnPitch     float64 `json:"column_pitch"`
+	A1X             float64 `json:"a1_x"`
+	A1Y             float64 `json:"a1_y"`
+	ZOffset         float64 `json:"z_offset"`
+	WellShape       string  `json:"well_shape"`       // circular or rectangular
+	WellDiameter    float64 `json:"well_diameter"`    // Circular wells
+	WellXDimension  float64 `json:"well_x_dimension"` // Rectangular wells
+	WellYDimension  float64 `json:"well_y_dimension"` // Rectangular wells
+	WellDepth       float64 `json:"well_depth"`
+	WellVolume      float64 `json:"well_volume"` // µL
+	WellBottomShape string  `json:"well_bottom_shape"`
+	XDimension      float64 `json:"x_dimension"`
+	YDimension      float64 `json:"y_dimension"`
+	ZDimension      float64 `json:"z_dimension"`
+	Naming          string  `json:"naming"`
+}
+
+// GenerateLabware generates the Labware of a grid. WellShape defaults to
+// circular, DisplayCategory to other, and Naming to NamingRowColumn.
+func GenerateLabware(grid LabwareGrid) (Labware, error) {
+	if grid.WellShape == "" {
+		grid.WellShape = "circular"
+	}
+	if grid.DisplayCategory == "" {
+		grid.DisplayCategory = "other"
+	}
+	if grid.DisplayName == "" {
+		grid.DisplayName = grid.Name
+	}
+	if grid.Naming == "" {
+		grid.Naming = NamingRowColumn
+	}
+	const tolerance = 1e-9 // mm
+	if grid.Name == "" {
+		return Labware{}, fmt.Errorf("Name is required")
+	}
+	if grid.Rows < 1 || grid.Columns < 1 {
+		return Labware{}, fmt.Errorf("Rows and columns must be positive")
+	}
+	if (grid.Rows > 1 && grid.RowPitch <= 0) || (grid.Columns > 1 && grid.ColumnPitch <= 0) {
+		return Labware{}, fmt.Errorf("Row and column pitch must be positive")
+	}
+	if grid.WellDepth <= 0 {
+		return Labware{}, fmt.Errorf("Well depth must be positive")
+	}
+	if grid.ZOffset < 0 || grid.ZOffset+grid.WellDepth > grid.ZDimension+tolerance {
+		return Labware{}, fmt.Errorf("Wells must fit within the height of the labware")
+	}
+	halfX, halfY := grid.WellDiameter/2, grid.WellDiameter/2
+	if grid.WellShape == "rectangular" {
+		halfX, halfY = grid.WellXDimension/2, grid.WellYDimension/2
+	}
+	lastX := grid.A1X + float64(grid.Columns-1)*grid.ColumnPitch
+	lastY := grid.A1Y - float64(grid.Rows-1)*grid.RowPitch
+	if grid.A1X-halfX < -tolerance || lastX+halfX > grid.XDimension+tolerance || lastY-halfY < -tolerance || grid.A1Y+halfY > grid.YDimension+tolerance {
+		return Labware{}, fmt.Errorf("Wells must fit within the %gx%gmm footprint of the labware", grid.XDimension, grid.YDimension)
+	}
+
+	var address func(row, column int) string
+	switch grid.Naming {
+	case NamingRowColumn:
+		if grid.Rows > 26 {
+			return Labware{}, fmt.Errorf("Naming %s supports at most 26 rows", NamingRowColumn)
+		}
+		address = func(row, column int) string { return fmt.Sprintf("%c%d", 'A'+row, column+1) }
+	case NamingNumeric:
+		address = func(row, column int) string { return strconv.Itoa(column*grid.Rows + row + 1) }
+	default:
+		return Labware{}, fmt.Errorf("Naming must be %s or %s, got: %s", NamingRowColumn, NamingNumeric, grid.Naming)
+	}
+
+	labware := Labware{
+		Name:            grid.Name,
+		Version:         grid.Version,
+		DisplayName:     grid.DisplayName,
+		DisplayCategory: grid.DisplayCategory,
+		XDimension:      grid.XDimension,
+		YDimension:      grid.YDimension,
+		ZDimension:      grid.ZDimension,
+	}
+	if labware.Version == 0 {
+		labware.Version = 1
+	}
+	group := WellGroup{Metadata: WellGroupMetadata{WellBottomShape: grid.WellBottomShape}}
+	for column := 0; column < grid.Columns; column++ {
+		var addresses []string
+		for row := 0; row < grid.Rows; row++ {
+			well := Well{
+				Address:           address(row, column),
+				Depth:             grid.WellDepth,
+				Shape:             grid.WellShape,
+				TotalLiquidVolume: grid.WellVolume,
+				X:                 grid.A1X + float64(column)*grid.ColumnPitch,
+				Y:                 grid.A1Y - float64(row)*grid.RowPitch,
+				Z:                 grid.ZOffset,
+			}
+			if grid.WellShape == "rectangular" {
+				well.XDimension = grid.WellXDimension
+				well.YDimension = grid.WellYDimension
+			} else {
+				well.Diameter = grid.WellDiameter
+			}
+			labware.Wells = append(labware.Wells, well)
+			addresses = append(addresses, well.Address)
+		}
+		labware.Ordering = append(labware.Ordering, addresses)
+		group.Wells = append(group.Wells, addresses...)
+	}
+	labware.Groups = WellGroups{group}
+
+	err := ValidateLabware(labware)
+	if err != nil {
+		return Labware{}, err
+	}
+	return labware, nil
+}
+
+/******************************************************************************
+
+                                Optimization
+
+******************************************************************************/
+
+// OptimizeOptions choose the optimizations applied to compiled Commands.
+type OptimizeOptions struct {
+	// Optimize merges redundant retracts, moves between wells of a labware
+	// just above them, and travels between labwares at the travel height of
+	// the deck.
+	Optimize bool `json:"optimize"`
+	// Reorder reorders independent tip cycles, such as hit picks, to
+	// minimize travel.
+	Reorder bool `json:"reorder"`
+}
+
+// DefaultOptimizeOptions are used by runs unless they opt out.
+var DefaultOptimizeOptions = OptimizeOptions{Optimize: true}
+
+// OptimizeCommands optimizes the path of compiled Commands.
+func OptimizeCommands(commands []Command, options OptimizeOptions) []Command {
+	if options.Reorder {
+		commands = reorderTipCycles(commands)
+	}
+	if options.Optimize {
+		commands = mergeRetracts(commands)
+		commands = lowerRetracts(commands)
+		commands = travelBetweenLabwares(commands)
+	}
+	return commands
+}
+
+// mergeRetracts removes moves that do not take the arm anywhere new: moves
+// to where the arm already is, retracting out of a well only to go back into
+// it, and stopping above a labware on the way to another well.
+func mergeRetracts(commands []Command) []Command {
+	var merged []Command
+	last := -1 // Index of the last move in merged
+	for i, command := range commands {
+		if command.Command != "move" {
+			merged = append(merged, command)
+			continue
+		}
+		if last >= 0 && merged[last].Pose == command.Pose {
+			continue
+		}
+		// Drop a retract followed by a move back down into the same well
+		if command.retract && i+1 < len(commands) {
+			next := commands[i+1]
+			if next.Command == "move" && next.Target == command.Target && command.Target != "" && last >= 0 && merged[last].Target == command.Target {
+				continue
+			}
+		}
+		// Drop a retract between two retracts at the same height
+		if command.retract && last >= 0 && last == len(merged)-1 && merged[last].retract && i+1 < len(commands) {
+			next := commands[i+1]
+			if next.Command == "move" && next.retract && next.Pose.Position.Z == command.Pose.Position.Z && merged[last].Pose.Position.Z == command.Pose.Position.Z {
+				continue
+			}
+		}
+		merged = append(merged, command)
+		last = len(merged) - 1
+	}
+	return merged
+}
+
+// RetractClearance is how far above the wells of a labware the arm moves
+// between them, in mm.
+var RetractClearance = 1.0
+
+// lowerRetracts moves between wells of the same labware just above the tops
+// of the wells, rather than clear of the whole labware.
+func lowerRetracts(commands []Command) []Command {
+	lowered := make([]Command, len(commands))
+	copy(lowered, commands)
+	for i := 1; i < len(lowered); i++ {
+		previous, command := &lowered[i-1], &lowered[i]
+		if previous.Command != "move" || command.Command != "move" || !previous.retract || !command.retract {
+			continue
+		}
+		if previous.placement != command.placement || previous.Target == command.Target {
+			continue
+		}
+		z := math.Max(previous.top, command.top) + RetractClearance
+		if z < previous.Pose.Position.Z && z < command.Pose.Position.Z {
+			previous.Pose.Position.Z = z
+			command.Pose.Position.Z = z
+		}
+	}
+	return lowered
+}
+
+// travelBetweenLabwares raises moves from above one labware to above
+// another to the travel height of the deck, so the arm clears taller
+// labwares in between.
+func travelBetweenLabwares(commands []Command) []Command {
+	var traveled []Command
+	for i, command := range commands {
+		if i > 0 && command.Command == "move" && command.retract {
+			previous := commands[i-1]
+			travel := command.travel
+			if previous.Command == "move" && previous.retract && previous.placement != command.placement && previous.placement.Deck == command.placement.Deck && travel > previous.Pose.Position.Z && travel > command.Pose.Position.Z {
+				up, over := previous, command
+				up.Pose.Position.Z = travel
+				over.Pose.Position.Z = travel
+				traveled = append(traveled, up, over)
+			}
+		}
+		traveled = append(traveled, command)
+	}
+	return traveled
+}
+
+// tipCycle is a run of Commands from picking up a tip to dropping it.
+type tipCycle struct {
+	commands []Command
+	wells    map[string]bool     // Wells liquid is handled in
+	start    kinematics.Position // Where liquid is first handled
+	end      kinematics.Position // Where liquid is last handled
+}
+
+// reorderTipCycles reorders consecutive tip cycles compiled from the same
+// step, such as the transfers of a hit pick, so that each cycle starts with
+// the closest liquid handling to the end of the last. Cycles are only
+// reordered if no well is handled by more than one of them, since then they
+// are independent.
+func reorderTipCycles(commands []Command) []Command {
+	var reordered []Command
+	for i := 0; i < len(commands); {
+		var cycles []tipCycle
+		j := i
+		for j < len(commands) && startsTipCycle(commands[j:]) && commands[j].Step == commands[i].Step {
+			cycle, ok := nextTipCycle(commands[j:])
+			if !ok {
+				break
+			}
+			cycles = append(cycles, cycle)
+			j += len(cycle.commands)
+		}
+		if len(cycles) < 2 || !independentCycles(cycles) {
+			reordered = append(reordered, commands[i])
+			i++
+			continue
+		}
+
+		// Greedily pick the nearest cycle to the end of the last one
+		position := cycles[0].start
+		for len(cycles) > 0 {
+			nearest := 0
+			for k, cycle := range cycles {
+				if distance(position, cycle.start) < distance(position, cycles[nearest].start) {
+					nearest = k
+				}
+			}
+			reordered = append(reordered, cycles[nearest].commands...)
+			position = cycles[nearest].end
+			cycles = append(cycles[:nearest], cycles[nearest+1:]...)
+		}
+		i = j
+	}
+	return reordered
+}
+
+// startsTipCycle returns whether commands start by moving to a tip and
+// picking it up.
+func startsTipCycle(commands []Command) bool {
+	for _, command := range commands {
+		if command.Target != commands[0].Target {
+			return false
+		}
+		if command.Command == "pick_up_tip" {
+			return true
+		}
+		if command.Command != "move" {
+			return false
+		}
+	}
+	return false
+}
+
+// nextTipCycle reads the tip cycle at the start of commands. The cycle must
+// be compiled from a single step, and handle liquid.
+func nextTipCycle(commands []Command) (tipCycle, bool) {
+	cycle := tipCycle{wells: make(map[string]bool)}
+	var position kinematics.Position
+	handled := false
+	for i, command := range commands {
+		if command.Step != commands[0].Step {
+			return cycle, false
+		}
+		switch command.Command {
+		case "move":
+			position = command.Pose.Position
+		case "aspirate", "dispense", "blow_out":
+			if !handled {
+				cycle.start = position
+				handled = true
+			}
+			cycle.end = position
+			cycle.wells[command.Target] = true
+		case "drop_tip":
+			// Include the retract after dropping the tip
+			end := i + 1
+			if end < len(commands) && commands[end].Command == "move" && commands[end].retract {
+				end++
+			}
+			cycle.commands = commands[:end]
+			return cycle, handled
+		}
+	}
+	return cycle, false
+}
+
+func independentCycles(cycles []tipCycle) bool {
+	seen := make(map[string]bool)
+	for _, cycle := range cycles {
+		for well := range cycle.wells {
+			if seen[well] {
+				return false
+			}
+		}
+		for well := range cycle.wells {
+			seen[well] = true
+		}
+	}
+	return true
+}
+
+func distance(a kinematics.Position, b kinematics.Position) float64 {
+	return math.Sqrt(math.Pow(b.X-a.X, 2) + math.Pow(b.Y-a.Y, 2) + math.Pow(b.Z-a.Z, 2))
+}
+
+/******************************************************************************
+
+                                Estimates
+
+******************************************************************************/
+
+// MoveParameters are the speed and acceleration parameters passed to
+// ar3.Arm.Move. Speed is a percentage of the arm's maximum speed. A move
+// spends its first AccDur percent accelerating from AccSpd percent of Speed,
+// and its last DccDur percent decelerating to DccSpd percent of Speed.
+type MoveParameters struct {
+	Speed  int
+	AccDur int
+	AccSpd int
+	DccDur int
+	DccSpd int
+}
+
+// DefaultMoveParameters are used for every move of a protocol.
+var DefaultMoveParameters = MoveParameters{Speed: 25, AccDur: 10, AccSpd: 10, DccDur: 10, DccSpd: 10}
+
+// EstimatedMaxSpeed is the approximate speed of the end effector in mm/s at a
+// Speed of 100. It is used to estimate how long protocols take.
+var EstimatedMaxSpeed = 200.0
+
+// Estimate is the estimated duration of a protocol and of each of its steps.
+type Estimate struct {
+	Duration int            `json:"duration"` // Milliseconds
+	Steps    []StepEstimate `json:"steps"`
+}
+
+// StepEstimate is the estimated duration of a single protocol step.
+type StepEstimate struct {
+	Step     int `json:"step"`
+	Duration int `json:"duration"` // Milliseconds
+}
+
+// moveDuration estimates the seconds taken to move a distance in mm, from the
+// time spent at cruising speed and while accelerating and decelerating.
+func moveDuration(distance float64, p MoveParameters) float64 {
+	speed := EstimatedMaxSpeed * float64(p.Speed) / 100
+	if speed <= 0 {
+		return 0
+	}
+	acc, dcc := float64(p.AccDur)/100, float64(p.DccDur)/100
+	// Ramps are linear, so run at the average of their start and end speeds
+	accSpeed := (1 + float64(p.AccSpd)/100) / 2
+	dccSpeed := (1 + float64(p.DccSpd)/100) / 2
+	return distance / speed * ((1 - acc - dcc) + acc/accSpeed + dcc/dccSpeed)
+}
+
+// EstimateProtocol estimates how long compiled Commands take to run from a
+// starting pose, using the straight line distance between poses and
+// DefaultMoveParameters, and the flow rates of the pipette.
+func EstimateProtocol(commands []Command, start kinematics.Pose) Estimate {
+	estimate := Estimate{Steps: []StepEstimate{}}
+	var total float64
+	position := start.Position
+	stepDurations := make(map[int]float64)
+	for _, command := range commands {
+		var duration float64
+		if command.Command == "move" {
+			target := command.Pose.Position
+			distance := math.Sqrt(math.Pow(target.X-position.X, 2) + math.Pow(target.Y-position.Y, 2) + math.Pow(target.Z-position.Z, 2))
+			duration = moveDuration(distance, DefaultMoveParameters)
+			position = target
+		} else if command.Command == "aspirate" || command.Command == "dispense" || command.Command == "air_gap" {
+			duration = command.Volume / command.FlowRate
+		} else {
+			duration = float64(command.WaitTime) / 1000
+		}
+		if _, ok := stepDurations[command.Step]; !ok {
+			estimate.Steps = append(estimate.Steps, StepEstimate{Step: command.Step})
+		}
+		stepDurations[command.Step] += duration
+		total += duration
+	}
+	for i, step := range estimate.Steps {
+		estimate.Steps[i].Duration = int(math.Round(stepDurations[step.Step] * 1000))
+	}
+	estimate.Duration = int(math.Round(total * 1000))
+	return estimate
+}
+
+// readyPose is the pose of the arm in its ready position.
+func readyPose() kinematics.Pose {
+	return kinematics.ForwardKinematics(readyJoints[:6], ar3.AR3DhParameters)
+}
+
+/******************************************************************************
+
+                                Runs
+
+******************************************************************************/
+
+// Run statuses stored in the activity_log.
+const (
+	RunRunning   = "RUNNING"
+	RunPaused    = "PAUSED"
+	RunFailed    = "FAILED"
+	RunCancelled = "CANCELLED"
+	RunCompleted = "COMPLETED"
+)
+
+// Run is a single execution of a protocol, as recorded in the activity_log.
+// Start and End are unix timestamps in seconds. LastCommand is the index of
+// the last compiled Command the arm completed. EstimatedDuration is the
+// estimate made when the run started, in milliseconds.
+type Run struct {
+	ID                int64           `json:"id" db:"id"`
+	Start             int64           `json:"start" db:"start"`
+	End               *int64          `json:"end" db:"end"`
+	Program           json.RawMessage `json:"program" db:"program"`
+	Status            string          `json:"status" db:"status"`
+	StatusMessage     *string         `json:"status_message" db:"status_message"`
+	LastCommand       *int64          `json:"last_command" db:"last_command"`
+	EstimatedDuration *int64          `json:"estimated_duration" db:"estimated_duration"`
+	Labwares          LabwareVersions `json:"labwares" db:"labwares"`
+	Placements        Placements      `json:"placements" db:"placements"`
+}
+
+// LabwareVersion is a version of a labware used by a run.
+type LabwareVersion struct {
+	Name    string `json:"name"`
+	Version int    `json:"version"`
+}
+
+type LabwareVersions []LabwareVersion
+
+func (v *LabwareVersions) Scan(src interface{}) error  { return scanJSON(src, v) }
+func (v LabwareVersions) Value() (driver.Value, error) { return valueJSON(v) }
+
+// Placements is the deck layout used by a run: the labware version at each
+// deck location that it moves to.
+type Placements []Placement
+
+func (p *Placements) Scan(src interface{}) error  { return scanJSON(src, p) }
+func (p Placements) Value() (driver.Value, error) { return valueJSON(p) }
+
+func GetRuns(tx *sqlx.Tx) ([]Run, error) {
+	runs := []Run{}
+	err := tx.Select(&runs, "SELECT id, start, end, program, status, status_message, last_command, estimated_duration, labwares, placements FROM activity_log ORDER BY id")
+	if err != nil {
+		return runs, err
+	}
+	return runs, nil
+}
+
+func GetRun(tx *sqlx.Tx, id int64) (Run, error) {
+	var run Run
+	err := tx.Get(&run, "SELECT id, start, end, program, status, status_message, last_command, estimated_duration, labwares, placements FROM activity_log WHERE id = ?", id)
+	if err != nil {
+		return run, err
+	}
+	return run, nil
+}
+
+// CreateRun records a new RUNNING run of program in the activity_log.
+func CreateRun(tx *sqlx.Tx, program []byte) (int64, error) {
+	result, err := tx.Exec("INSERT INTO activity_log(start, program, status) VALUES (?, ?, ?)", time.Now().Unix(), program, RunRunning)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// SetRunLabwares records the labware versions a run uses.
+func SetRunLabwares(tx *sqlx.Tx, id int64, labwares LabwareVersions) error {
+	_, err := tx.Exec("UPDATE activity_log SET labwares = ? WHERE id = ?", labwares, id)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// SetRunPlacements records the deck layout a run uses.
+func SetRunPlacements(tx *sqlx.Tx, id int64, placements Placements) error {
+	_, err := tx.Exec("UPDATE activity_log SET placements = ? WHERE id = ?", placements, id)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// usedPlacements lists the placements that commands move to, sorted by deck,
+// location and labware.
+func usedPlacements(commands []Command) Placements {
+	placements := Placements{}
+	seen := make(map[Placement]bool)
+	for _, command := range commands {
+		if command.placement.LabwareName == "" || seen[command.placement] {
+			continue
+		}
+		seen[command.placement] = true
+		placements = append(placements, command.placement)
+	}
+	sort.Slice(placements, func(i, j int) bool {
+		a, b := placements[i], placements[j]
+		if a.Deck != b.Deck {
+			return a.Deck < b.Deck
+		}
+		if a.Location != b.Location {
+			return a.Location < b.Location
+		}
+		if a.LabwareName != b.LabwareName {
+			return a.LabwareName < b.LabwareName
+		}
+		return a.LabwareVersion < b.LabwareVersion
+	})
+	return placements
+}
+
+// usedLabwareVersions lists the labware versions that commands move to,
+// sorted by name and version.
+func usedLabwareVersions(commands []Command) LabwareVersions {
+	labwares := LabwareVersions{}
+	seen := make(map[LabwareVersion]bool)
+	for _, command := range commands {
+		used := LabwareVersion{Name: command.placement.LabwareName, Version: command.placement.LabwareVersion}
+		if used.Name == "" || seen[used] {
+			continue
+		}
+		seen[used] = true
+		labwares = append(labwares, used)
+	}
+	sort.Slice(labwares, func(i, j int) bool {
+		if labwares[i].Name != labwares[j].Name {
+			return labwares[i].Name < labwares[j].Name
+		}
+		return labwares[i].Version < labwares[j].Version
+	})
+	return labwares
+}
+
+// SetRunStatus updates the status of a run that is still in progress.
+func SetRunStatus(tx *sqlx.Tx, id int64, status string, statusMessage string) error {
+	_, err := tx.Exec("UPDATE activity_log SET status = ?, status_message = ? WHERE id = ?", status, statusMessage, id)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// SetRunEstimate records the estimated duration of a run in milliseconds.
+func SetRunEstimate(tx *sqlx.Tx, id int64, estimatedDuration int) error {
+	_, err := tx.Exec("UPDATE activity_log SET estimated_duration = ? WHERE id = ?", estimatedDuration, id)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// SetRunProgress records the index of the last Command completed by a run.
+func SetRunProgress(tx *sqlx.Tx, id int64, lastCommand int) error {
+	_, err := tx.Exec("UPDATE activity_log SET last_command = ? WHERE id = ?", lastCommand, id)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// FailUnfinishedRuns marks the runs that are still RUNNING or PAUSED as
+// FAILED. It is called on startup, since no Runner executes those runs
+// anymore.
+func FailUnfinishedRuns(tx *sqlx.Tx) error {
+	var ids []int64
+	err := tx.Select(&ids, "SELECT id FROM activity_log WHERE status IN (?, ?) ORDER BY id", RunRunning, RunPaused)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		err = FinishRun(tx, id, RunFailed, "Server restarted")
+		if err != nil {
+			return err
+		}
+		err = CreateRunEvent(tx, RunEvent{Run: id, Type: EventStatus, Status: RunFailed, Message: "Server restarted"})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FinishRun sets the final status of a run and its end time.
+func FinishRun(tx *sqlx.Tx, id int64, status string, statusMessage string) error {
+	_, err := tx.Exec("UPDATE activity_log SET end = ?, status = ?, status_message = ? WHERE id = ?", time.Now().Unix(), status, statusMessage, id)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// errRunCancelled stops a run that has been cancelled.
+var errRunCancelled = errors.New("Run cancelled")
+
+// errEStop stops a run when the emergency stop is pressed.
+var errEStop = errors.New("estop")
+
+// EStopError is returned for motion requests while the emergency stop is
+// latched.
+type EStopError struct{}
+
+func (e EStopError) Error() string {
+	return "Emergency stop is latched. Reset the emergency stop to re-home the arm"
+}
+
+// StatusCode returns 503 Service Unavailable, since no motion is possible
+// until the emergency stop is reset.
+func (e EStopError) StatusCode() int { return 503 }
+
+// runControl lets a run be paused, resumed and cancelled between Commands.
+type runControl struct {
+	mu        sync.Mutex
+	resumed   *sync.Cond
+	paused    bool
+	cancelled error
+}
+
+func newRunControl() *runControl {
+	control := &runControl{}
+	control.resumed = sync.NewCond(&control.mu)
+	return control
+}
+
+// checkpoint is called between Commands. It calls onPause and blocks while
+// the run is paused, and returns the reason for cancelling once the run is
+// cancelled.
+func (c *runControl) checkpoint(onPause func(), onResume func()) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.paused && c.cancelled == nil {
+		onPause()
+		for c.paused && c.cancelled == nil {
+			c.resumed.Wait()
+		}
+		if c.cancelled == nil {
+			onResume()
+		}
+	}
+	return c.cancelled
+}
+
+// err returns the reason the run was cancelled, if it has been.
+func (c *runControl) err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cancelled
+}
+
+func (c *runControl) setPaused(paused bool) {
+	c.mu.Lock()
+	c.paused = paused
+	c.mu.Unlock()
+	c.resumed.Broadcast()
+}
+
+func (c *runControl) cancel(reason error) {
+	c.mu.Lock()
+	c.cancelled = reason
+	c.mu.Unlock()
+	c.resumed.Broadcast()
+}
+
+// readyJoints are the joint angles of the position the arm waits in between
+// runs.
+var readyJoints = [7]float64{0, 0, math.Pi / 4, 0, -math.Pi / 4, 0, 0}
+
+// readyArm moves the arm to its ready position.
+func readyArm(arm ar3.Arm) error {
+	j := readyJoints
+	return arm.MoveJointRadians(25, 10, 10, 10, 10, j[0], j[1], j[2], j[3], j[4], j[5], j[6])
+}
+
+// homeArm calibrates every joint of the arm against its limit switch, then
+// moves it to its ready position unless homing was aborted meanwhile.
+func homeArm(arm ar3.Arm, aborted func() bool) error {
+	err := arm.Calibrate(50, true, true, true, true, true, true, false)
+	if err != nil {
+		return err
+	}
+	if aborted() {
+		return errEStop
+	}
+	return readyArm(arm)
+}
+
+// Runner executes protocols on an arm and pipette in the background, one run
+// at a time, and controls the runs that are in flight.
+type Runner struct {
+	DB      *sqlx.DB
+	Arm     ar3.Arm
+	Pipette Pipette
+
+	mu       sync.Mutex
+	runs     map[int64]*runControl
+	estopped bool
+	estops   int  // Times the emergency stop was pressed, to abort homing
+	homing   bool // Re-homing the arm to reset the emergency stop
+	starting int  // Runs started that are not registered yet
+
+	eventsMu sync.Mutex
+	events   chan struct{}
+}
+
+func NewRunner(db *sqlx.DB, arm ar3.Arm, pipette Pipette) *Runner {
+	return &Runner{DB: db, Arm: arm, Pipette: pipette, runs: make(map[int64]*runControl), events: make(chan struct{})}
+}
+
+// Start compiles a protocol, records it in the activity_log and then executes
+// it in the background. It returns the ID of the new run.
+func (r *Runner) Start(protocol []CommandInput, options OptimizeOptions) (int64, error) {
+	// Runs that are starting keep the emergency stop from being reset, so
+	// the arm is not homed while they ask where it is
+	r.mu.Lock()
+	if r.estopped {
+		r.mu.Unlock()
+		return 0, EStopError{}
+	}
+	r.starting++
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		r.starting--
+		r.mu.Unlock()
+	}()
+	program, err := EncodeProtocol(protocol)
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := r.DB.Beginx()
+	if err != nil {
+		return 0, err
+	}
+	id, err := CreateRun(tx, program)
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	err = AcquireLock(tx, id)
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	// Holding the lock, the arm and pipette are idle and can be asked where
+	// they are and what they hold
+	commands, err := compileProtocol(tx, r.Pipette, protocol, r.Pipette.HasTip(), r.Pipette.Volume())
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	commands = OptimizeCommands(commands, options)
+	err = CheckReachability(commands, r.Arm.CurrentJointRadians())
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	err = SetRunLabwares(tx, id, usedLabwareVersions(commands))
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	err = SetRunPlacements(tx, id, usedPlacements(commands))
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	estimate := EstimateProtocol(commands, r.Arm.CurrentPose())
+	err = SetRunEstimate(tx, id, estimate.Duration)
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	err = CreateRunEvent(tx, RunEvent{Run: id, Type: EventStatus, Status: RunRunning})
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+
+	// The emergency stop may have been pressed while the run was prepared,
+	// before it could be cancelled
+	control := newRunControl()
+	r.mu.Lock()
+	if r.estopped {
+		r.mu.Unlock()
+		r.endRun(id, RunFailed, errEStop.Error())
+		return 0, EStopError{}
+	}
+	r.runs[id] = control
+	r.mu.Unlock()
+
+	go r.run(id, commands, control)
+	return id, nil
+}
+
+// Pause pauses a run once its current Command has finished.
+func (r *Runner) Pause(id int64) error {
+	control, err := r.control(id)
+	if err != nil {
+		return err
+	}
+	control.setPaused(true)
+	return nil
+}
+
+// Resume continues a paused run from the Command after its last completed
+// Command.
+func (r *Runner) Resume(id int64) error {
+	if r.EStopped() {
+		return EStopError{}
+	}
+	control, err := r.control(id)
+	if err != nil {
+		return err
+	}
+	control.setPaused(false)
+	return nil
+}
+
+// Cancel stops a run once its current Command has finished.
+func (r *Runner) Cancel(id int64) error {
+	control, err := r.control(id)
+	if err != nil {
+		return err
+	}
+	control.cancel(errRunCancelled)
+	return nil
+}
+
+// EStop latches the emergency stop. Every run in progress is stopped and
+// marked as FAILED, and no motion is allowed until ResetEStop is called.
+// This is a soft stop: the ar3 driver cannot halt a move in progress, so the
+// arm stops once its current move finishes. A hardware emergency stop is
+// still needed to cut power to the arm immediately.
+func (r *Runner) EStop() error {
+	r.mu.Lock()
+	r.estopped = true
+	r.estops++
+	var ids []int64
+	for id, control := range r.runs {
+		control.cancel(errEStop)
+		ids = append(ids, id)
+	}
+	r.mu.Unlock()
+
+	for _, id := range ids {
+		r.setStatus(id, RunFailed, errEStop.Error())
+	}
+	return nil
+}
+
+// EStopped returns whether the emergency stop is latched.
+func (r *Runner) EStopped() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.estopped
+}
+
+// ResetEStop re-homes the arm and then releases the emergency stop. It fails
+// while a stopped run is still waiting for its last move to finish. The
+// emergency stop can be pressed again while the arm re-homes, which aborts
+// the reset.
+func (r *Runner) ResetEStop() error {
+	r.mu.Lock()
+	for id := range r.runs {
+		r.mu.Unlock()
+		return fmt.Errorf("Run %d is still stopping", id)
+	}
+	if r.starting > 0 {
+		r.mu.Unlock()
+		return fmt.Errorf("A run is still starting")
+	}
+	if r.homing {
+		r.mu.Unlock()
+		return fmt.Errorf("Arm is already re-homing")
+	}
+	r.homing = true
+	estops := r.estops
+	r.mu.Unlock()
+
+	aborted := func() bool {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		return r.estops != estops
+	}
+	err := homeArm(r.Arm, aborted)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.homing = false
+	if r.estops != estops {
+		return fmt.Errorf("Emergency stop was pressed while re-homing the arm")
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to re-home arm: %s", err)
+	}
+	r.estopped = false
+	return nil
+}
+
+// ForceReleaseLock wraps the package level ForceReleaseLock, which releases
+// a stale device lock and marks the run holding it as FAILED. It refuses
+// while that run is still executing, since the arm would keep moving under a
+// run that no longer holds the lock.
+func (r *Runner) ForceReleaseLock() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	tx, err := r.DB.Beginx()
+	if err != nil {
+		return err
+	}
+	lock, err := GetLock(tx)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if lock.LockedBy != nil {
+		_, active := r.runs[*lock.LockedBy]
+		if active || r.starting > 0 {
+			_ = tx.Rollback()
+			return fmt.Errorf("Run %d is still in progress, cancel it instead: %w", *lock.LockedBy, LockedError{RunID: *lock.LockedBy})
+		}
+	}
+	err = ForceReleaseLock(tx)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (r *Runner) control(id int64) (*runControl, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	control, ok := r.runs[id]
+	if !ok {
+		return nil, fmt.Errorf("Run %d is not in progress", id)
+	}
+	return control, nil
+}
+
+// run executes compiled commands, then records the outcome of the run and
+// releases the device lock, even if execution panics.
+func (r *Runner) run(id int64, commands []Command, control *runControl) {
+	status, statusMessage := RunFailed, ""
+	defer func() {
+		if rec := recover(); rec != nil {
+			status, statusMessage = RunFailed, fmt.Sprintf("Run panicked: %v", rec)
+		}
+		r.mu.Lock()
+		delete(r.runs, id)
+		r.mu.Unlock()
+		r.endRun(id, status, statusMessage)
+	}()
+
+	onPause := func() { r.setStatus(id, RunPaused, "") }
+	onResume := func() { r.setStatus(id, RunRunning, "") }
+	for i, command := range commands {
+		err := control.checkpoint(onPause, onResume)
+		if err == errRunCancelled {
+			status, statusMessage = RunCancelled, err.Error()
+			return
+		}
+		if err != nil {
+			statusMessage = err.Error()
+			return
+		}
+		// Never move while the emergency stop is latched
+		if r.EStopped() {
+			statusMessage = errEStop.Error()
+			return
+		}
+
+		index, command := i, command
+		r.record(id, func(tx *sqlx.Tx) error {
+			return CreateRunEvent(tx, RunEvent{Run: id, Type: EventCommandStarted, CommandIndex: &index, Command: command.Command, Pose: &command.Pose})
+		})
+		if command.Command == "pause" {
+			// Wait for an operator to resume the run, showing them the message
+			control.setPaused(true)
+			err = control.checkpoint(func() { r.setStatus(id, RunPaused, command.Message) }, onResume)
+			if err == errRunCancelled {
+				status, statusMessage = RunCancelled, err.Error()
+				return
+			}
+			if err != nil {
+				statusMessage = err.Error()
+				return
+			}
+		}
+		err = executeCommand(r.Arm, r.Pipette, command)
+		if err != nil {
+			statusMessage = fmt.Sprintf("command %d: %s", i, err)
+			// Moves halted by the emergency stop fail because of it
+			if control.err() == errEStop {
+				statusMessage = errEStop.Error()
+			}
+			r.record(id, func(tx *sqlx.Tx) error {
+				return CreateRunEvent(tx, RunEvent{Run: id, Type: EventError, CommandIndex: &index, Command: command.Command, Pose: &command.Pose, Message: err.Error()})
+			})
+			return
+		}
+		r.record(id, func(tx *sqlx.Tx) error {
+			err := SetRunProgress(tx, id, index)
+			if err != nil {
+				return err
+			}
+			if command.Tip != nil {
+				err = UseTip(tx, *command.Tip)
+				if err != nil {
+					return err
+				}
+			}
+			return CreateRunEvent(tx, RunEvent{Run: id, Type: EventCommandCompleted, CommandIndex: &index, Command: command.Command, Pose: &command.Pose})
+		})
+	}
+	status = RunCompleted
+}
+
+// record applies an update to a run in its own transaction, then notifies
+// listeners of run events. Failures are only logged, since the run cannot
+// stop to report them.
+func (r *Runner) record(id int64, update func(*sqlx.Tx) error) {
+	tx, err := r.DB.Beginx()
+	if err != nil {
+		log.Printf("Failed to record progress of run %d: %s", id, err)
+		return
+	}
+	err = update(tx)
+	if err != nil {
+		_ = tx.Rollback()
+		log.Printf("Failed to record progress of run %d: %s", id, err)
+		return
+	}
+	err = tx.Commit()
+	if err != nil {
+		log.Printf("Failed to record progress of run %d: %s", id, err)
+		return
+	}
+	r.notify()
+}
+
+func (r *Runner) setStatus(id int64, status string, statusMessage string) {
+	r.record(id, func(tx *sqlx.Tx) error {
+		err := SetRunStatus(tx, id, status, statusMessage)
+		if err != nil {
+			return err
+		}
+		return CreateRunEvent(tx, RunEvent{Run: id, Type: EventStatus, Status: status, Message: statusMessage})
+	})
+}
+
+// endRun finishes a run and releases the device lock held by it.
+func (r *Runner) endRun(id int64, status string, statusMessage string) {
+	r.record(id, func(tx *sqlx.Tx) error {
+		err := FinishRun(tx, id, status, statusMessage)
+		if err != nil {
+			return err
+		}
+		err = ReleaseLock(tx, id)
+		if err != nil {
+			return err
+		}
+		return CreateRunEvent(tx, RunEvent{Run: id, Type: EventStatus, Status: status, Message: statusMessage})
+	})
+}
+
+// Events returns a channel that is closed when the next run event is
+// recorded.
+func (r *Runner) Events() <-chan struct{} {
+	r.eventsMu.Lock()
+	defer r.eventsMu.Unlock()
+	return r.events
+}
+
+func (r *Runner) notify() {
+	r.eventsMu.Lock()
+	close(r.events)
+	r.events = make(chan struct{})
+	r.eventsMu.Unlock()
+}
+
+/******************************************************************************
+
+                                Run events
+
+******************************************************************************/
+
+// Types of RunEvent.
+const (
+	EventStatus           = "status"
+	EventCommandStarted   = "command_started"
+	EventCommandCompleted = "command_completed"
+	EventError            = "error"
+)
+
+// RunEvent is a single change in the progress of a run: a change of status,
+// the start or completion of a compiled Command, or an error.
+type RunEvent struct {
+	ID           int64            `json:"id"`
+	Run          int64            `json:"run"`
+	Time         time.Time        `json:"time"`
+	Type         string           `json:"type"`
+	Status       string           `json:"status,omitempty"`
+	CommandIndex *int             `json:"command_index,omitempty"`
+	Command      string           `json:"command,omitempty"`
+	Pose         *kinematics.Pose `json:"pose,omitempty"`
+	Message      string           `json:"message,omitempty"`
+}
+
+// CreateRunEvent records a RunEvent, timestamping it if it has no time.
+func CreateRunEvent(tx *sqlx.Tx, event RunEvent) error {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO activity_event(run, data) VALUES (?, ?)", event.Run, data)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetRunEvents gets the events of a run recorded after the event afterID.
+func GetRunEvents(tx *sqlx.Tx, run int64, afterID int64) ([]RunEvent, error) {
+	var rows []struct {
+		ID   int64  `db:"id"`
+		Data []byte `db:"data"`
+	}
+	events := []RunEvent{}
+	err := tx.Select(&rows, "SELECT id, data FROM activity_event WHERE run = ? AND id > ? ORDER BY id", run, afterID)
+	if err != nil {
+		return events, err
+	}
+	for _, row := range rows {
+		var event RunEvent
+		err = json.Unmarshal(row.Data, &event)
+		if err != nil {
+			return events, err
+		}
+		event.ID = row.ID
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+/******************************************************************************
+
+                                Lock
+
+******************************************************************************/
+
+// Lock is the device lock. Only the run holding the lock may drive the arm.
+type Lock struct {
+	Active   bool   `json:"active" db:"active"`
+	LockedBy *int64 `json:"locked_by" db:"locked_by"`
+}
+
+// LockedError is returned when the device lock is held by another run.
+type LockedError struct {
+	RunID int64
+}
+
+func (e LockedError) Error() string {
+	return fmt.Sprintf("Device is locked by run %d", e.RunID)
+}
+
+// StatusCode returns 409 Conflict, since the request may succeed once the
+// holding run finishes.
+func (e LockedError) StatusCode() int { return 409 }
+
+func GetLock(tx *sqlx.Tx) (Lock, error) {
+	var lock Lock
+	err := tx.Get(&lock, "SELECT active, locked_by FROM lock WHERE id = 1")
+	if err != nil {
+		return lock, err
+	}
+	return lock, nil
+}
+
+// AcquireLock takes the device lock for a run, returning a LockedError if
+// another run already holds it.
+func AcquireLock(tx *sqlx.Tx, runID int64) error {
+	result, err := tx.Exec("UPDATE lock SET active = 1, locked_by = ? WHERE id = 1 AND active = 0", runID)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		lock, err := GetLock(tx)
+		if err != nil {
+			return err
+		}
+		var holder int64
+		if lock.LockedBy != nil {
+			holder = *lock.LockedBy
+		}
+		return LockedError{holder}
+	}
+	return nil
+}
+
+// ReleaseLock releases the device lock if it is held by runID.
+func ReleaseLock(tx *sqlx.Tx, runID int64) error {
+	_, err := tx.Exec("UPDATE lock SET active = 0, locked_by = NULL WHERE id = 1 AND locked_by = ?", runID)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// ForceReleaseLock releases the device lock regardless of which run holds it.
+// It is intended for recovering from a crash, so a holding run that is still
+// RUNNING or PAUSED is marked as FAILED.
+func ForceReleaseLock(tx *sqlx.Tx) error {
+	lock, err := GetLock(tx)
+	if err != nil {
+		return err
+	}
+	if lock.LockedBy != nil {
+		_, err = tx.Exec("UPDATE activity_log SET end = ?, status = ?, status_message = ? WHERE id = ? AND status IN (?, ?)", time.Now().Unix(), RunFailed, "Device lock was force released", *lock.LockedBy, RunRunning, RunPaused)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec("UPDATE lock SET active = 0, locked_by = NULL WHERE id = 1")
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+/******************************************************************************
+
+                                Defaults
+
+******************************************************************************/
+
+type OpentronsParameters struct {
+	Format                     string  `json:"format"`
+	IsTiprack                  bool    `json:"isTiprack"`
+	TipLength                  float64 `json:"tipLength,omitempty"`
+	TipOverlap                 float64 `json:"tipOverlap,omitempty"`
+	IsMagneticModuleCompatible bool    `json:"isMagneticModuleCompatible"`
+	LoadName                   string  `json:"loadName"`
+}
+
+type OpentronsDimensions struct {
+	XDimension float64 `json:"xDimension"`
+	YDimension float64 `json:"yDimension"`
+	ZDimension float64 `json:"zDimension"`
+}
+
+type OpentronsMetadata struct {
+	DisplayName        string   `json:"displayName"`
+	DisplayCategory    string   `json:"displayCategory"`
+	DisplayVolumeUnits string   `json:"displayVolumeUnits"`
+	Tags               []string `json:"tags"`
+}
+
+// OpentronsWell is a well of an Opentrons labware definition, which only
+// carries the dimensions of its shape.
+type OpentronsWell struct {
+	Depth             float64 `json:"depth"`
+	TotalLiquidVolume float64 `json:"totalLiquidVolume"`
+	Shape             string  `json:"shape"`
+	Diameter          float64 `json:"diameter,omitempty"`
+	XDimension        float64 `json:"xDimension,omitempty"`
+	YDimension        float64 `json:"yDimension,omitempty"`
+	X                 float64 `json:"x"`
+	Y                 float64 `json:"y"`
+	Z                 float64 `json:"z"`
+}
+
+// OpentronsLabware is a labware definition of the Opentrons labware schema
+// v2.
+type OpentronsLabware struct {
+	Ordering             WellOrdering             `json:"ordering"`
+	Brand                LabwareBrand             `json:"brand"`
+	Metadata             OpentronsMetadata        `json:"metadata"`
+	Dimensions           OpentronsDimensions      `json:"dimensions"`
+	Wells                map[string]OpentronsWell `json:"wells"`
+	Groups               WellGroups               `json:"groups"`
+	Parameters           OpentronsParameters      `json:"parameters"`
+	Namespace            string                   `json:"namespace"`
+	Version              int                      `json:"version"`
+	SchemaVersion        int                      `json:"schemaVersion"`
+	CornerOffsetFromSlot Offset                   `json:"cornerOffsetFromSlot"`
 }
 
 func opentronsLabwareToLabware(ol OpentronsLabware) Labware {
-	var wells []Well
+	byAddress := make(map[string]Well)
 	for address, well := range ol.Wells {
-		newWell := well
-		newWell.Address = address
-		wells = append(wells, newWell)
+		byAddress[address] = Well{Address: address, Depth: well.Depth, Shape: well.Shape, Diameter: well.Diameter, XDimension: well.XDimension, YDimension: well.YDimension, TotalLiquidVolume: well.TotalLiquidVolume, X: well.X, Y: well.Y, Z: well.Z}
+	}
+	var wells []Well
+	for _, address := range orderedAddresses(ol.Ordering, byAddress) {
+		wells = append(wells, byAddress[address])
+	}
+	// Brand IDs, links and tags are omitted when empty, so empty lists are
+	// read as none
+	ol.Brand = normalizeBrand(ol.Brand)
+	for i, group := range ol.Groups {
+		if group.Brand != nil {
+			brand := normalizeBrand(*group.Brand)
+			ol.Groups[i].Brand = &brand
+		}
+	}
+	var tags LabwareTags
+	if len(ol.Metadata.Tags) > 0 {
+		tags = ol.Metadata.Tags
+	}
+	return Labware{
+		Name:                       ol.Parameters.LoadName,
+		Version:                    ol.Version,
+		Namespace:                  ol.Namespace,
+		DisplayName:                ol.Metadata.DisplayName,
+		DisplayCategory:            ol.Metadata.DisplayCategory,
+		DisplayVolumeUnits:         ol.Metadata.DisplayVolumeUnits,
+		Tags:                       tags,
+		Brand:                      ol.Brand,
+		Format:                     ol.Parameters.Format,
+		XDimension:                 ol.Dimensions.XDimension,
+		YDimension:                 ol.Dimensions.YDimension,
+		ZDimension:                 ol.Dimensions.ZDimension,
+		CornerOffsetFromSlot:       ol.CornerOffsetFromSlot,
+		IsTiprack:                  ol.Parameters.IsTiprack,
+		IsMagneticModuleCompatible: ol.Parameters.IsMagneticModuleCompatible,
+		TipLength:                  ol.Parameters.TipLength,
+		TipOverlap:                 ol.Parameters.TipOverlap,
+		Ordering:                   ol.Ordering,
+		Groups:                     ol.Groups,
+		Wells:                      wells,
+	}
+}
+
+func normalizeBrand(brand LabwareBrand) LabwareBrand {
+	if len(brand.BrandID) == 0 {
+		brand.BrandID = nil
+	}
+	if len(brand.Links) == 0 {
+		brand.Links = nil
+	}
+	return brand
+}
+
+// LabwareToOpentrons converts a labware back to an Opentrons labware schema
+// v2 definition. Fields the labware leaves empty, such as the namespace of a
+// labware that was not imported, are filled in as for a custom labware.
+func LabwareToOpentrons(labware Labware) OpentronsLabware {
+	wells := make(map[string]OpentronsWell)
+	for _, well := range labware.Wells {
+		openWell := OpentronsWell{Depth: well.Depth, TotalLiquidVolume: well.TotalLiquidVolume, Shape: well.Shape, X: well.X, Y: well.Y, Z: well.Z}
+		if well.Shape == "rectangular" {
+			openWell.XDimension = well.XDimension
+			openWell.YDimension = well.YDimension
+		} else {
+			openWell.Diameter = well.Diameter
+		}
+		wells[well.Address] = openWell
+	}
+
+	ordering := labware.Ordering
+	if len(ordering) == 0 {
+		ordering = columnOrdering(wellOrder(labware.Wells))
+	}
+	groups := labware.Groups
+	if len(groups) == 0 {
+		groups = WellGroups{{Wells: orderedAddresses(ordering, wellsByAddress(labware.Wells))}}
+	}
+	version := labware.Version
+	if version < 1 {
+		version = 1
+	}
+	namespace := labware.Namespace
+	if namespace == "" {
+		namespace = "custom_beta"
+	}
+	format := labware.Format
+	if format == "" {
+		format = "irregular"
+		switch len(wells) {
+		case 96:
+			format = "96Standard"
+		case 384:
+			format = "384Standard"
+		}
+	}
+	units := labware.DisplayVolumeUnits
+	if units == "" {
+		units = "µL"
+	}
+	tags := []string{}
+	if labware.Tags != nil {
+		tags = labware.Tags
+	}
+
+	return OpentronsLabware{
+		Ordering: ordering,
+		Brand:    labware.Brand,
+		Metadata: OpentronsMetadata{
+			DisplayName:        labware.DisplayName,
+			DisplayCategory:    labware.DisplayCategory,
+			DisplayVolumeUnits: units,
+			Tags:               tags,
+		},
+		Dimensions: OpentronsDimensions{XDimension: labware.XDimension, YDimension: labware.YDimension, ZDimension: labware.ZDimension},
+		Wells:      wells,
+		Groups:     groups,
+		Parameters: OpentronsParameters{
+			Format:                     format,
+			IsTiprack:                  labware.IsTiprack,
+			TipLength:                  labware.TipLength,
+			TipOverlap:                 labware.TipOverlap,
+			IsMagneticModuleCompatible: labware.IsMagneticModuleCompatible,
+			LoadName:                   labware.Name,
+		},
+		Namespace:            namespace,
+		Version:              version,
+		SchemaVersion:        2,
+		CornerOffsetFromSlot: labware.CornerOffsetFromSlot,
+	}
+}
+
+// columnOrdering groups ordered wells into columns of addresses.
+func columnOrdering(wells []Well) WellOrdering {
+	var ordering WellOrdering
+	lastColumn := -1
+	for _, well := range wells {
+		_, column := splitAddress(well.Address)
+		if len(ordering) == 0 || column != lastColumn {
+			ordering = append(ordering, []string{})
+			lastColumn = column
+		}
+		ordering[len(ordering)-1] = append(ordering[len(ordering)-1], well.Address)
+	}
+	return ordering
+}
+
+func wellsByAddress(wells []Well) map[string]Well {
+	byAddress := make(map[string]Well)
+	for _, well := range wells {
+		byAddress[well.Address] = well
+	}
+	return byAddress
+}
+
+// orderedAddresses lists the addresses of wells by their ordering, followed
+// by any wells missing from the ordering, sorted.
+func orderedAddresses(ordering WellOrdering, wells map[string]Well) []string {
+	var addresses []string
+	seen := make(map[string]bool)
+	for _, column := range ordering {
+		for _, address := range column {
+			if _, ok := wells[address]; ok && !seen[address] {
+				addresses = append(addresses, address)
+				seen[address] = true
+			}
+		}
+	}
+	var rest []string
+	for address := range wells {
+		if !seen[address] {
+			rest = append(rest, address)
+		}
 	}
-	return Labware{Name: ol.Parameters.LoadName, ZDimension: ol.Dimensions.ZDimension, Wells: wells}
+	sort.Strings(rest)
+	return append(addresses, rest...)
 }
 
 //go:embed data/**/*
@@ -375,13 +3874,100 @@ func defaultLabware() ([]Labware, error) {
 			return labwares, err
 		}
 
-		var opentronsLabware OpentronsLabware
-		err = json.Unmarshal(fileBytes, &opentronsLabware)
+		labware, err := decodeOpentronsLabware(fileBytes, true)
 		if err != nil {
-			return labwares, err
+			return labwares, fmt.Errorf("%s: %s", match, err)
+		}
+		// Definitions are laid out as data/<loadName>/<version>.json
+		expected := fmt.Sprintf("data/%s/%d.json", labware.Name, labware.Version)
+		if match != expected {
+			return labwares, fmt.Errorf("%s: Definition should be at %s", match, expected)
+		}
+		labwares = append(labwares, labware)
+	}
+	return labwares, nil
+}
+
+// DecodeOpentronsLabware decodes and validates an Opentrons labware schema
+// v2 definition, such as one made with the Opentrons Labware Creator.
+// Violations of the schema and of ValidateLabware are reported together.
+func DecodeOpentronsLabware(data []byte) (Labware, error) {
+	return decodeOpentronsLabware(data, false)
+}
+
+func decodeOpentronsLabware(data []byte, embedded bool) (Labware, error) {
+	var ol OpentronsLabware
+	err := json.Unmarshal(data, &ol)
+	if err != nil {
+		return Labware{}, err
+	}
+	labware := opentronsLabwareToLabware(ol)
+	// The ordering is checked as given, not as completed by the conversion
+	labware.Ordering = ol.Ordering
+
+	var violations []LabwareViolation
+	if ol.SchemaVersion != 2 {
+		violations = append(violations, LabwareViolation{Field: "schemaVersion", Message: fmt.Sprintf("only schema version 2 is supported, got: %d", ol.SchemaVersion)})
+	}
+	if ol.Version < 1 {
+		violations = append(violations, LabwareViolation{Field: "version", Message: "must be at least 1"})
+	}
+	if len(ol.Ordering) == 0 {
+		violations = append(violations, LabwareViolation{Field: "ordering", Message: "is required"})
+	}
+	err = validateLabware(labware, embedded)
+	var invalid LabwareValidationError
+	if errors.As(err, &invalid) {
+		violations = append(violations, invalid.Violations...)
+	}
+	for i := range violations {
+		if violations[i].Field == "name" {
+			violations[i].Field = "parameters.loadName"
+		}
+	}
+	if len(violations) > 0 {
+		return Labware{}, LabwareValidationError{Violations: violations}
+	}
+	return labware, nil
+}
+
+// ReadOpentronsLabwares reads Opentrons labware definitions from either a
+// single JSON definition or a zip of JSON definitions.
+func ReadOpentronsLabwares(data []byte) ([]Labware, error) {
+	if !bytes.HasPrefix(data, []byte("PK\x03\x04")) {
+		labware, err := DecodeOpentronsLabware(data)
+		if err != nil {
+			return nil, err
 		}
+		return []Labware{labware}, nil
+	}
 
-		labwares = append(labwares, opentronsLabwareToLabware(opentronsLabware))
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	var labwares []Labware
+	for _, file := range archive.File {
+		if file.FileInfo().IsDir() || !strings.HasSuffix(strings.ToLower(file.Name), ".json") {
+			continue
+		}
+		reader, err := file.Open()
+		if err != nil {
+			return nil, err
+		}
+		fileBytes, err := ioutil.ReadAll(reader)
+		_ = reader.Close()
+		if err != nil {
+			return nil, err
+		}
+		labware, err := DecodeOpentronsLabware(fileBytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", file.Name, err)
+		}
+		labwares = append(labwares, labware)
+	}
+	if len(labwares) == 0 {
+		return nil, fmt.Errorf("Zip has no JSON labware definitions")
 	}
 	return labwares, nil
 }
@@ -392,20 +3978,46 @@ func defaultLabware() ([]Labware, error) {
 
 ******************************************************************************/
 
+// CreateDatabase creates the tables of Schema and adds the default
+// labwares. A database made by an older Schema is migrated first, and runs
+// left unfinished by a previous server are failed.
 func CreateDatabase(db *sqlx.DB) error {
-	_, err := db.Exec(Schema)
+	err := migrateDatabase(db)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(Schema)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(fmt.Sprintf("PRAGMA user_version = %d", schemaVersion))
 	if err != nil {
 		return err
 	}
-	// Add in default labwares
+	// Add in default labwares, unless they were added before
 	defaultLabwares, err := defaultLabware()
 	if err != nil {
 		return err
 	}
 	tx := db.MustBegin()
+	err = FailUnfinishedRuns(tx)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
 	for _, labware := range defaultLabwares {
-		err = CreateLabware(tx, labware)
+		var exists bool
+		err = tx.Get(&exists, "SELECT EXISTS(SELECT 1 FROM labware WHERE name = ? AND version = ?)", labware.Name, labware.Version)
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+		if exists {
+			continue
+		}
+		err = createLabware(tx, labware, true)
 		if err != nil {
+			_ = tx.Rollback()
 			return err
 		}
 	}
@@ -416,24 +4028,223 @@ func CreateDatabase(db *sqlx.DB) error {
 	return nil
 }
 
+// schemaVersion is the version of Schema, which is stored as the
+// user_version of the database. Databases made before versioning are at 0.
+const schemaVersion = 1
+
+// rebuiltTables are the tables whose keys or constraints changed since
+// version 0, such as the primary key of labware and the run statuses of
+// activity_log. SQLite cannot alter those, so the tables are rebuilt.
+var rebuiltTables = []string{"labware", "well", "activity_log"}
+
+// addedColumns are the columns added to the other tables since version 0.
+var addedColumns = []struct{ table, column, definition string }{
+	{"deck", "travel_height", "REAL NOT NULL DEFAULT 0"},
+}
+
+// migrateDatabase migrates a database made by an older Schema up to
+// schemaVersion. Rebuilt tables keep the rows and the columns they share
+// with the current Schema, and new columns take their defaults. New tables
+// are left for Schema to create, and stored default labwares are replaced
+// by the embedded definitions.
+func migrateDatabase(db *sqlx.DB) error {
+	ctx := context.Background()
+	// Pragmas apply to a single connection
+	conn, err := db.Connx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var version int
+	err = conn.GetContext(ctx, &version, "PRAGMA user_version")
+	if err != nil {
+		return err
+	}
+	existing, err := tableColumns(ctx, conn, "labware")
+	if err != nil {
+		return err
+	}
+	if version >= schemaVersion || len(existing) == 0 {
+		return nil
+	}
+
+	// Foreign keys of other tables must keep referencing the rebuilt tables
+	// by name, so they are neither checked nor renamed along with them.
+	_, err = conn.ExecContext(ctx, "PRAGMA foreign_keys = OFF; PRAGMA legacy_alter_table = ON")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_, _ = conn.ExecContext(ctx, "PRAGMA foreign_keys = ON; PRAGMA legacy_alter_table = OFF")
+	}()
+	tx, err := conn.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	err = migrateTables(ctx, tx)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateTables(ctx context.Context, tx *sqlx.Tx) error {
+	columns := make(map[string][]string)
+	for _, table := range rebuiltTables {
+		old, err := tableColumns(ctx, tx, table)
+		if err != nil {
+			return err
+		}
+		if len(old) == 0 {
+			continue
+		}
+		columns[table] = old
+		_, err = tx.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s RENAME TO old_%s", table, table))
+		if err != nil {
+			return err
+		}
+	}
+	_, err := tx.ExecContext(ctx, Schema)
+	if err != nil {
+		return err
+	}
+	for _, table := range rebuiltTables {
+		if len(columns[table]) == 0 {
+			continue
+		}
+		current, err := tableColumns(ctx, tx, table)
+		if err != nil {
+			return err
+		}
+		var shared []string
+		for _, column := range columns[table] {
+			for _, name := range current {
+				if column == name {
+					shared = append(shared, column)
+				}
+			}
+		}
+		list := strings.Join(shared, ", ")
+		_, err = tx.ExecContext(ctx, fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM old_%s", table, list, list, table))
+		if err != nil {
+			return fmt.Errorf("Failed to migrate %s: %s", table, err)
+		}
+		_, err = tx.ExecContext(ctx, "DROP TABLE old_"+table)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, added := range addedColumns {
+		current, err := tableColumns(ctx, tx, added.table)
+		if err != nil {
+			return err
+		}
+		found := false
+		for _, name := range current {
+			found = found || name == added.column
+		}
+		if len(current) > 0 && !found {
+			_, err = tx.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", added.table, added.column, added.definition))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// Older schemas stored only part of the default labwares, so they are
+	// replaced. Missing defaults are added by CreateDatabase.
+	defaultLabwares, err := defaultLabware()
+	if err != nil {
+		return err
+	}
+	for _, labware := range defaultLabwares {
+		var exists bool
+		err = tx.GetContext(ctx, &exists, "SELECT EXISTS(SELECT 1 FROM labware WHERE name = ? AND version = ?)", labware.Name, labware.Version)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			continue
+		}
+		_, err = tx.ExecContext(ctx, "DELETE FROM well WHERE labware = ? AND version = ?", labware.Name, labware.Version)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, "DELETE FROM labware WHERE name = ? AND version = ?", labware.Name, labware.Version)
+		if err != nil {
+			return err
+		}
+		err = createLabware(tx, labware, true)
+		if err != nil {
+			return fmt.Errorf("Failed to migrate %s: %s", labware.Name, err)
+		}
+	}
+	return nil
+}
+
+// tableColumns lists the columns of a table, or none if it does not exist.
+func tableColumns(ctx context.Context, q sqlx.QueryerContext, table string) ([]string, error) {
+	var columns []string
+	err := sqlx.SelectContext(ctx, q, &columns, "SELECT name FROM pragma_table_info(?) ORDER BY cid", table)
+	if err != nil {
+		return nil, err
+	}
+	return columns, nil
+}
+
 const Schema = `
 PRAGMA journal_mode = WAL;
 PRAGMA foreign_keys = ON;
 
 -- Add labware and deck
 CREATE TABLE IF NOT EXISTS labware (
+	name TEXT NOT NULL,
+	version INTEGER NOT NULL DEFAULT 1,
+	namespace TEXT NOT NULL DEFAULT '',
+	display_name TEXT NOT NULL DEFAULT '',
+	display_category TEXT NOT NULL DEFAULT '',
+	display_volume_units TEXT NOT NULL DEFAULT '',
+	tags TEXT NOT NULL DEFAULT 'null', -- JSON
+	brand TEXT NOT NULL DEFAULT '{}', -- JSON
+	format TEXT NOT NULL DEFAULT '',
+	xdimension REAL NOT NULL DEFAULT 0,
+	ydimension REAL NOT NULL DEFAULT 0,
+	zdimension REAL NOT NULL,
+	corner_offset_from_slot TEXT NOT NULL DEFAULT '{}', -- JSON
+	is_tiprack BOOLEAN NOT NULL DEFAULT false,
+	is_magnetic_module_compatible BOOLEAN NOT NULL DEFAULT false,
+	tip_length REAL NOT NULL DEFAULT 0,
+	tip_overlap REAL NOT NULL DEFAULT 0,
+	ordering TEXT NOT NULL DEFAULT 'null', -- JSON
+	groups TEXT NOT NULL DEFAULT 'null', -- JSON
+	PRIMARY KEY (name, version)
+);
+
+-- Add the default version of each labware, otherwise the latest is used
+CREATE TABLE IF NOT EXISTS labware_default (
 	name TEXT PRIMARY KEY,
-	zdimension REAL NOT NULL
+	version INTEGER NOT NULL,
+	FOREIGN KEY (name, version) REFERENCES labware(name, version) ON DELETE CASCADE
 );
 
 CREATE TABLE IF NOT EXISTS well (
-	labware TEXT NOT NULL REFERENCES labware(name) ON DELETE CASCADE,
+	labware TEXT NOT NULL,
+	version INTEGER NOT NULL DEFAULT 1,
 	address TEXT NOT NULL,
 	depth REAL NOT NULL,
-	diameter REAL NOT NULL,
+	shape TEXT NOT NULL DEFAULT 'circular',
+	diameter REAL NOT NULL DEFAULT 0,
+	xdimension REAL NOT NULL DEFAULT 0,
+	ydimension REAL NOT NULL DEFAULT 0,
+	total_liquid_volume REAL NOT NULL DEFAULT 0,
 	x REAL NOT NULL,
 	y REAL NOT NULL,
-	z REAL NOT NULL
+	z REAL NOT NULL,
+	FOREIGN KEY (labware, version) REFERENCES labware(name, version) ON DELETE CASCADE,
+	UNIQUE (labware, version, address)
 );
 
 CREATE TABLE IF NOT EXISTS deck (
@@ -445,7 +4256,8 @@ CREATE TABLE IF NOT EXISTS deck (
 	qw REAL NOT NULL DEFAULT 0,
 	qx REAL NOT NULL DEFAULT 0,
 	qy REAL NOT NULL DEFAULT 0,
-	qz REAL NOT NULL DEFAULT 0
+	qz REAL NOT NULL DEFAULT 0,
+	travel_height REAL NOT NULL DEFAULT 0
 );
 
 CREATE TABLE IF NOT EXISTS location (
@@ -460,14 +4272,34 @@ CREATE TABLE IF NOT EXISTS location (
         qz REAL NOT NULL
 );
 
+-- Add tip inventory, as the tips used from the tip rack at each location
+CREATE TABLE IF NOT EXISTS used_tip (
+    deck TEXT NOT NULL REFERENCES deck(name) ON DELETE CASCADE,
+    location TEXT NOT NULL,
+    labware TEXT NOT NULL,
+    address TEXT NOT NULL,
+    PRIMARY KEY (deck, location, address)
+);
+
 -- Add activity log
 CREATE TABLE IF NOT EXISTS activity_log (
     id INTEGER PRIMARY KEY AUTOINCREMENT,
     start INTEGER NOT NULL,
     end INTEGER,
     program TEXT NOT NULL,
-    status TEXT NOT NULL CHECK (status IN ('RUNNING', 'FAILED', 'COMPLETED')),
-    status_message TEXT
+    status TEXT NOT NULL CHECK (status IN ('RUNNING', 'PAUSED', 'FAILED', 'CANCELLED', 'COMPLETED')),
+    status_message TEXT,
+    last_command INTEGER,
+    estimated_duration INTEGER,
+    labwares TEXT NOT NULL DEFAULT '[]', -- JSON, the labware versions used
+    placements TEXT NOT NULL DEFAULT '[]' -- JSON, the deck layout used
+);
+
+-- Add activity events, which are streamed to run listeners
+CREATE TABLE IF NOT EXISTS activity_event (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    run INTEGER NOT NULL REFERENCES activity_log(id) ON DELETE CASCADE,
+    data TEXT NOT NULL
 );
 
 -- Add device lock
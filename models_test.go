@@ -1,12 +1,20 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"github.com/trilobio/kinematics"
+	"math"
+	"reflect"
+	"strings"
 	"testing"
 )
 
 func TestLabware(t *testing.T) {
-	labware1 := Labware{"plate1", 10, []Well{Well{Address: "A1", Depth: 1, Diameter: 1, X: 1, Y: 1, Z: 1}}}
-	labware2 := Labware{"plate2", 20, []Well{Well{Address: "A1", Depth: 2, Diameter: 2, X: 2, Y: 2, Z: 2}}}
+	labware1 := Labware{Name: "plate1", ZDimension: 10, Wells: []Well{Well{Address: "A1", Depth: 1, Diameter: 1, X: 1, Y: 1, Z: 1}}}
+	labware2 := Labware{Name: "plate2", ZDimension: 20, Wells: []Well{Well{Address: "A1", Depth: 2, Diameter: 2, X: 2, Y: 2, Z: 2}}}
 	tx := db.MustBegin()
 
 	var err error
@@ -51,6 +59,345 @@ func TestLabware(t *testing.T) {
 	}
 }
 
+func TestValidateLabware(t *testing.T) {
+	labware := Labware{Name: "invalid_plate", XDimension: 20, YDimension: 20, ZDimension: 10, Wells: []Well{
+		Well{Address: "A1", Depth: 5, Diameter: 5, X: 5, Y: 5, Z: 1},
+		Well{Address: "A1", Depth: -1, Diameter: -2, X: 25, Y: 5, Z: 1},
+		Well{Address: "B1", Depth: 9, Shape: "rectangular", XDimension: 5, YDimension: 5, X: 5, Y: 15, Z: 2},
+		Well{Address: "C1", Depth: 5, Shape: "rectangular", XDimension: 4, YDimension: 6, X: 15, Y: 18, Z: 1}, // Center inside, edge outside
+	}}
+	err := ValidateLabware(labware)
+	var invalid LabwareValidationError
+	if !errors.As(err, &invalid) {
+		t.Fatalf("Invalid labware should fail with a LabwareValidationError. Got: %v", err)
+	}
+	expected := []LabwareViolation{
+		{Field: "wells.A1.address", Message: "is not unique"},
+		{Field: "wells.A1.depth", Message: "must not be negative"},
+		{Field: "wells.A1.diameter", Message: "must be positive"},
+		{Field: "wells.A1.x", Message: "well is outside the 20mm width of the labware"},
+		{Field: "wells.B1.z", Message: "top of the well is above the 10mm height of the labware"},
+		{Field: "wells.C1.y", Message: "well is outside the 20mm length of the labware"},
+	}
+	if !reflect.DeepEqual(invalid.Violations, expected) {
+		t.Errorf("Every violation should be listed.\nGot:  %v\nWant: %v", invalid.Violations, expected)
+	}
+	err = ValidateLabware(Labware{Name: "empty_plate", ZDimension: 10})
+	if err == nil || !strings.Contains(err.Error(), "wells: labware has no wells") {
+		t.Errorf("Labware without wells should fail. Got: %v", err)
+	}
+
+	tx := db.MustBegin()
+	defer func() { _ = tx.Rollback() }()
+	err = CreateLabware(tx, labware)
+	if !errors.As(err, &invalid) {
+		t.Errorf("CreateLabware should validate the labware. Got: %v", err)
+	}
+
+	// Embedded labware is valid, with tubes standing above their racks
+	labwares, err := defaultLabware()
+	if err != nil {
+		t.Fatalf("Failed to read default labware. Got error: %s", err)
+	}
+	for _, labware := range labwares {
+		err = validateLabware(labware, true)
+		if err != nil {
+			t.Errorf("Embedded %s should be valid. Got: %s", labware.Name, err)
+		}
+	}
+
+	// Only tip racks may stand above their labware when not embedded
+	tubeRack := Labware{Name: "tall_tubes", DisplayCategory: "tubeRack", XDimension: 20, YDimension: 20, ZDimension: 10, Wells: []Well{
+		Well{Address: "A1", Depth: 15, Diameter: 5, X: 10, Y: 10, Z: 1},
+	}}
+	err = ValidateLabware(tubeRack)
+	if err == nil || !strings.Contains(err.Error(), "wells.A1.z: top of the well is above") {
+		t.Errorf("A display category should not relax validation. Got: %v", err)
+	}
+	tubeRack.IsTiprack, tubeRack.TipLength = true, 15
+	err = ValidateLabware(tubeRack)
+	if err != nil {
+		t.Errorf("Tips should stand above their tip rack. Got: %s", err)
+	}
+}
+
+func TestLabwareVersions(t *testing.T) {
+	tx := db.MustBegin()
+	defer func() { _ = tx.Rollback() }()
+
+	plate, err := GetLabware(tx, "nest_96_wellplate_100ul_pcr_full_skirt")
+	if err != nil {
+		t.Fatalf("Failed to get plate. Got error: %s", err)
+	}
+	if plate.Version != 1 {
+		t.Errorf("Embedded plate should be version 1. Got: %d", plate.Version)
+	}
+	revised := plate
+	revised.Version = 2
+	revised.Wells = append([]Well{}, plate.Wells...)
+	revised.Wells[0].X += 1
+	err = CreateLabware(tx, revised)
+	if err != nil {
+		t.Fatalf("Failed to create version 2. Got error: %s", err)
+	}
+	err = CreateLabware(tx, revised)
+	if err == nil {
+		t.Errorf("Creating an existing version should fail")
+	}
+
+	// The latest version is the default
+	labware, err := GetLabware(tx, plate.Name)
+	if err != nil || labware.Version != 2 || labware.Wells[0].X != plate.Wells[0].X+1 {
+		t.Errorf("Latest version should be the default. Got: %v %d", err, labware.Version)
+	}
+	versions, err := GetLabwareVersions(tx, plate.Name)
+	if err != nil || len(versions) != 2 || versions[0].Version != 1 {
+		t.Errorf("Both versions should be listed. Got: %v %d", err, len(versions))
+	}
+	labwares, err := GetLabwares(tx)
+	if err != nil {
+		t.Fatalf("Failed to get all labwares. Got error: %s", err)
+	}
+	for _, labware := range labwares {
+		if labware.Name == plate.Name && labware.Version != 2 {
+			t.Errorf("Only the default version should be listed. Got: %d", labware.Version)
+		}
+	}
+
+	// Commands pin a version, and compile to the version they use
+	moveTo := func(version int) CommandMove {
+		return CommandMove{Deck: "deck", Location: "1", LabwareName: plate.Name, LabwareVersion: version, Address: "A1", DepthFromBottom: 1}
+	}
+	commands, err := CompileProtocol(tx, ConnectMockPipette(300), []CommandInput{moveTo(0), moveTo(1)})
+	if err != nil {
+		t.Fatalf("Failed to compile protocol. Got error: %s", err)
+	}
+	if commands[0].Pose.Position.X != commands[3].Pose.Position.X+1 {
+		t.Errorf("Pinned version should be used. Got: %g and %g", commands[0].Pose.Position.X, commands[3].Pose.Position.X)
+	}
+	used := usedLabwareVersions(commands)
+	if len(used) != 2 || used[0] != (LabwareVersion{plate.Name, 1}) || used[1] != (LabwareVersion{plate.Name, 2}) {
+		t.Errorf("Both versions should be used. Got: %v", used)
+	}
+	placements := usedPlacements(commands)
+	if len(placements) != 2 || placements[0] != (Placement{"deck", "1", plate.Name, 1}) || placements[1] != (Placement{"deck", "1", plate.Name, 2}) {
+		t.Errorf("Both versions should be placed at deck/1. Got: %v", placements)
+	}
+	_, err = CompileProtocol(tx, ConnectMockPipette(300), []CommandInput{moveTo(3)})
+	if err == nil {
+		t.Errorf("Pinning a missing version should fail")
+	}
+
+	// Set the default version back
+	err = SetDefaultLabwareVersion(tx, plate.Name, 1)
+	if err != nil {
+		t.Fatalf("Failed to set default version. Got error: %s", err)
+	}
+	labware, _ = GetLabware(tx, plate.Name)
+	if labware.Version != 1 {
+		t.Errorf("Default version should be 1. Got: %d", labware.Version)
+	}
+	err = SetDefaultLabwareVersion(tx, plate.Name, 3)
+	if err == nil {
+		t.Errorf("Setting a missing default version should fail")
+	}
+}
+
+func TestOpentronsLabware(t *testing.T) {
+	tx := db.MustBegin()
+	defer func() { _ = tx.Rollback() }()
+
+	tipRack, err := GetLabware(tx, "opentrons_96_tiprack_300ul")
+	if err != nil {
+		t.Fatalf("Failed to get tip rack. Got error: %s", err)
+	}
+	if !tipRack.IsTiprack || tipRack.TipLength != 59.3 || tipRack.DisplayCategory != "tipRack" || tipRack.Brand.Brand != "Opentrons" || tipRack.XDimension != 127.76 {
+		t.Errorf("Tip rack should be decoded from its definition. Got: %+v", tipRack)
+	}
+	if len(tipRack.Ordering) != 12 || tipRack.Ordering[1][0] != "A2" || tipRack.Wells[8].Address != "A2" {
+		t.Errorf("Tip rack wells should follow its ordering. Got: %v", tipRack.Ordering)
+	}
+	if tipRack.Wells[0].Shape != "circular" || tipRack.Wells[0].TotalLiquidVolume != 300 {
+		t.Errorf("Tip rack wells should be circular and hold 300µL. Got: %+v", tipRack.Wells[0])
+	}
+
+	reservoir, err := GetLabware(tx, "agilent_1_reservoir_290ml")
+	if err != nil {
+		t.Fatalf("Failed to get reservoir. Got error: %s", err)
+	}
+	well := reservoir.Wells[0]
+	if well.Shape != "rectangular" || well.XDimension != 108 || well.YDimension != 72 || well.TotalLiquidVolume != 290000 {
+		t.Errorf("Reservoir well should be rectangular. Got: %+v", well)
+	}
+	if len(reservoir.Groups) != 1 || reservoir.Groups[0].Metadata.WellBottomShape != "v" || reservoir.Brand.BrandID[0] != "201252-100" {
+		t.Errorf("Reservoir groups and brand should be decoded. Got: %+v %+v", reservoir.Groups, reservoir.Brand)
+	}
+}
+
+func TestExportOpentronsLabware(t *testing.T) {
+	labwares, err := defaultLabware()
+	if err != nil {
+		t.Fatalf("Failed to read default labware. Got error: %s", err)
+	}
+	for _, labware := range labwares {
+		definition, err := json.Marshal(LabwareToOpentrons(labware))
+		if err != nil {
+			t.Fatalf("Failed to encode %s. Got error: %s", labware.Name, err)
+		}
+		exported, err := decodeOpentronsLabware(definition, true)
+		if err != nil {
+			t.Errorf("Exported %s should be a valid definition. Got error: %s", labware.Name, err)
+			continue
+		}
+		if !reflect.DeepEqual(exported, labware) {
+			t.Errorf("Exported %s should round trip.\nGot:  %+v\nWant: %+v", labware.Name, exported, labware)
+		}
+	}
+
+	// An imported definition is exported as it was imported
+	file, err := content.ReadFile("data/opentrons_24_aluminumblock_nest_0.5ml_screwcap/1.json")
+	if err != nil {
+		t.Fatalf("Failed to read definition. Got error: %s", err)
+	}
+	imported, err := ReadOpentronsLabwares(file)
+	if err != nil {
+		t.Fatalf("Failed to read definition. Got error: %s", err)
+	}
+	tx := app.DB.MustBegin()
+	defer tx.Rollback()
+	tx.MustExec("DELETE FROM well WHERE labware = ?", imported[0].Name)
+	tx.MustExec("DELETE FROM labware WHERE name = ?", imported[0].Name)
+	err = CreateLabware(tx, imported[0])
+	if err != nil {
+		t.Fatalf("Failed to import definition. Got error: %s", err)
+	}
+	stored, err := GetLabwareVersion(tx, imported[0].Name, imported[0].Version)
+	if err != nil {
+		t.Fatalf("Failed to get imported labware. Got error: %s", err)
+	}
+	definition, err := json.Marshal(LabwareToOpentrons(stored))
+	if err != nil {
+		t.Fatalf("Failed to encode imported labware. Got error: %s", err)
+	}
+	var original, exported map[string]interface{}
+	_ = json.Unmarshal(file, &original)
+	_ = json.Unmarshal(definition, &exported)
+	// Empty brand IDs are omitted
+	delete(original["brand"].(map[string]interface{}), "brandId")
+	if !reflect.DeepEqual(exported, original) {
+		t.Errorf("Imported definition should export unchanged.\nGot:  %s\nWant: %s", definition, file)
+	}
+
+	// Labware without an ordering is exported column by column
+	plain := Labware{Name: "plain", ZDimension: 10, Wells: []Well{
+		Well{Address: "B1", Shape: "circular", Diameter: 5},
+		Well{Address: "A2", Shape: "rectangular", XDimension: 5, YDimension: 5},
+		Well{Address: "A1", Shape: "circular", Diameter: 5},
+	}}
+	ol := LabwareToOpentrons(plain)
+	if !reflect.DeepEqual(ol.Ordering, WellOrdering{{"A1", "B1"}, {"A2"}}) || len(ol.Groups) != 1 || len(ol.Groups[0].Wells) != 3 {
+		t.Errorf("Ordering and groups should be filled in. Got: %v %v", ol.Ordering, ol.Groups)
+	}
+	if ol.Wells["A2"].Diameter != 0 || ol.Wells["A1"].XDimension != 0 {
+		t.Errorf("Wells should only carry the dimensions of their shape. Got: %+v", ol.Wells)
+	}
+}
+
+func TestGenerateLabware(t *testing.T) {
+	grid := LabwareGrid{Name: "printed_24_tuberack", Rows: 4, Columns: 6, RowPitch: 19.3, ColumnPitch: 19.9, A1X: 14.4, A1Y: 71.2, ZOffset: 4, WellDiameter: 10, WellDepth: 40, WellVolume: 1500, XDimension: 127.76, YDimension: 85.48, ZDimension: 48}
+	labware, err := GenerateLabware(grid)
+	if err != nil {
+		t.Fatalf("Failed to generate labware. Got error: %s", err)
+	}
+	if len(labware.Wells) != 24 || len(labware.Ordering) != 6 || labware.Ordering[1][0] != "A2" || labware.Version != 1 {
+		t.Errorf("Labware should have 24 wells in 6 columns. Got: %d %v", len(labware.Wells), labware.Ordering)
+	}
+	d6 := labware.Wells[23]
+	if d6.Address != "D6" || math.Abs(d6.X-113.9) > 1e-9 || math.Abs(d6.Y-13.3) > 1e-9 || d6.Z != 4 || d6.Shape != "circular" || d6.Diameter != 10 {
+		t.Errorf("Well D6 should be at the far corner of the grid. Got: %+v", d6)
+	}
+
+	grid.Naming = NamingNumeric
+	labware, _ = GenerateLabware(grid)
+	if labware.Wells[1].Address != "2" || labware.Ordering[1][0] != "5" {
+		t.Errorf("Wells should be numbered down each column. Got: %v", labware.Ordering)
+	}
+
+	for _, invalid := range []LabwareGrid{
+		{Name: "no_rows", Columns: 1, WellDiameter: 1, WellDepth: 1, XDimension: 10, YDimension: 10, ZDimension: 10},
+		{Name: "too_tall", Rows: 1, Columns: 1, A1X: 5, A1Y: 5, WellDiameter: 1, WellDepth: 20, XDimension: 10, YDimension: 10, ZDimension: 10},
+		{Name: "too_wide", Rows: 1, Columns: 2, ColumnPitch: 9, A1X: 5, A1Y: 5, WellDiameter: 1, WellDepth: 1, XDimension: 10, YDimension: 10, ZDimension: 10},
+		{Name: "no_diameter", Rows: 1, Columns: 1, A1X: 5, A1Y: 5, WellDepth: 1, XDimension: 10, YDimension: 10, ZDimension: 10},
+		{Name: "bad_naming", Rows: 1, Columns: 1, A1X: 5, A1Y: 5, WellDiameter: 1, WellDepth: 1, XDimension: 10, YDimension: 10, ZDimension: 10, Naming: "roman"},
+	} {
+		_, err = GenerateLabware(invalid)
+		if err == nil {
+			t.Errorf("Generating %s should fail", invalid.Name)
+		}
+	}
+}
+
+func TestUpdateLabware(t *testing.T) {
+	tx := db.MustBegin()
+	defer func() { _ = tx.Rollback() }()
+	rack, err := GenerateLabware(LabwareGrid{Name: "update_rack", Rows: 2, Columns: 2, RowPitch: 20, ColumnPitch: 20, A1X: 20, A1Y: 60, WellDiameter: 10, WellDepth: 30, XDimension: 127.76, YDimension: 85.48, ZDimension: 40})
+	if err != nil {
+		t.Fatalf("Failed to generate labware. Got error: %s", err)
+	}
+	err = CreateLabware(tx, rack)
+	if err != nil {
+		t.Fatalf("Failed to create labware. Got error: %s", err)
+	}
+
+	// Fix the depth of a single well
+	patched, err := PatchLabware(rack, []byte(`{"displayName": "Update rack", "wells": [{"address": "B2", "depth": 28.5}]}`))
+	if err != nil {
+		t.Fatalf("Failed to patch labware. Got error: %s", err)
+	}
+	if rack.Wells[3].Depth != 30 {
+		t.Errorf("Patching should not change the original labware")
+	}
+	err = UpdateLabware(tx, patched, false)
+	if err != nil {
+		t.Fatalf("Failed to update labware. Got error: %s", err)
+	}
+	labware, _ := GetLabware(tx, "update_rack")
+	if labware.DisplayName != "Update rack" || labware.Wells[3].Depth != 28.5 || labware.Wells[2].Depth != 30 || len(labware.Wells) != 4 {
+		t.Errorf("Only the patched fields should change. Got: %+v", labware)
+	}
+
+	for _, patch := range []string{`{"name": "renamed"}`, `{"wells": [{"address": "Z9", "depth": 1}]}`, `{"wells": [{"address": "A1", "shape": "hexagonal"}]}`, `{"wells": [{"address": "A1", "depht": 5}]}`, `{"displayNmae": "Misspelled"}`} {
+		patched, err = PatchLabware(labware, []byte(patch))
+		if err == nil {
+			err = UpdateLabware(tx, patched, false)
+		}
+		if err == nil {
+			t.Errorf("Patch %s should fail", patch)
+		}
+	}
+
+	// Labware in use is only updated with force
+	err = UseTip(tx, Tip{Placement: Placement{Deck: "deck", Location: "1", LabwareName: "update_rack"}, Address: "A1"})
+	if err != nil {
+		t.Fatalf("Failed to use tip. Got error: %s", err)
+	}
+	id, err := CreateRun(tx, []byte(`[]`))
+	if err != nil {
+		t.Fatalf("Failed to create run. Got error: %s", err)
+	}
+	_ = SetRunPlacements(tx, id, Placements{{Deck: "deck", Location: "2", LabwareName: "update_rack", LabwareVersion: 1}, {Deck: "deck", Location: "3", LabwareName: "update_rack", LabwareVersion: 2}})
+	err = UpdateLabware(tx, labware, false)
+	var inUse LabwareInUseError
+	want := []string{"tip rack deck/1", fmt.Sprintf("run %d at deck/2", id)}
+	if !errors.As(err, &inUse) || !reflect.DeepEqual(inUse.References, want) {
+		t.Errorf("Update of labware in use should fail. Got: %v", err)
+	}
+	err = UpdateLabware(tx, labware, true)
+	if err != nil {
+		t.Errorf("Forced update should succeed. Got error: %s", err)
+	}
+}
+
 func TestDeck(t *testing.T) {
 	deck1 := InputDeck{Name: "deck1", Locations: []Location{Location{Name: "l1", X: 1, Y: 1, Z: 1}}}
 	deck2 := InputDeck{Name: "deck2", Locations: []Location{Location{Name: "l2", X: 2, Y: 2, Z: 2}}}
@@ -121,7 +468,7 @@ func TestExecuteProtocol(t *testing.T) {
 	var err error
 	tx := db.MustBegin()
 	// Calibrate deck
-	err = SetDeckCalibration(tx, "deck", 257, 0, 307, 0.8063737663657652, -0.575080903948282, -0.13494466363153904, 0.02886590702694046)
+	err = SetDeckCalibration(tx, "deck", 257, 0, 307, 0, 0.7071067811865476, 0, -0.7071067811865476)
 	if err != nil {
 		t.Errorf("Failed to SetDeckCalibration: %s", err)
 	}
@@ -133,14 +480,647 @@ func TestExecuteProtocol(t *testing.T) {
 
 	// Command MoveXYZ
 	var moves []CommandInput
-	moves = append(moves, CommandXyz{257, 0, 287, 0.8063737663657652, -0.575080903948282, -0.13494466363153904, 0.02886590702694046})
-	moves = append(moves, CommandXyz{257, 0, 307, 0.8063737663657652, -0.575080903948282, -0.13494466363153904, 0.02886590702694046}) // go up by 20
+	moves = append(moves, CommandXyz{257, 0, 287, 0, 0.7071067811865476, 0, -0.7071067811865476})
+	moves = append(moves, CommandXyz{257, 0, 307, 0, 0.7071067811865476, 0, -0.7071067811865476}) // go up by 20
 	moves = append(moves, CommandMove{Deck: "deck", Location: "1", LabwareName: "nest_96_wellplate_100ul_pcr_full_skirt", Address: "A1", DepthFromBottom: 1})
 	moves = append(moves, CommandMove{Deck: "deck", Location: "1", LabwareName: "nest_96_wellplate_100ul_pcr_full_skirt", Address: "B1", DepthFromBottom: 1})
 
-	// ExecuteProtocol
-	err = ExecuteProtocol(db, app.ArmMock, moves)
+	run := runProtocol(t, ConnectMockPipette(300), moves)
+	if run.Status != RunCompleted {
+		t.Errorf("Run should have COMPLETED. Got: %s %v", run.Status, run.StatusMessage)
+	}
+}
+
+// runProtocol runs a protocol with the Runner of the app and a pipette, and
+// waits for the run to finish.
+func runProtocol(t *testing.T, pipette Pipette, protocol []CommandInput) Run {
+	app.Runner.Pipette = pipette
+	defer func() { app.Runner.Pipette = app.Pipette }()
+	id, err := app.Runner.Start(protocol, DefaultOptimizeOptions)
+	if err != nil {
+		t.Fatalf("Failed to start run. Got error: %s", err)
+	}
+	return waitForRun(t, id)
+}
+
+func TestPipetteProtocol(t *testing.T) {
+	plate := Placement{Deck: "deck", Location: "1", LabwareName: "nest_96_wellplate_100ul_pcr_full_skirt"}
+	pipette := ConnectMockPipette(300)
+	_ = pipette.PickUpTip()
+	protocol := []CommandInput{
+		CommandAspirate{Placement: plate, Address: "A1", Volume: 100, DepthFromBottom: 1},
+		CommandDispense{Placement: plate, Address: "B1", Volume: 60, FlowRate: 20, DepthFromBottom: 1},
+		CommandDispense{Placement: plate, Address: "C1", Volume: 40, FlowRate: 20, DepthFromBottom: 1},
+	}
+	tx := db.MustBegin()
+	commands, err := compileProtocol(tx, pipette, protocol, pipette.HasTip(), pipette.Volume())
+	_ = tx.Rollback()
+	if err != nil {
+		t.Fatalf("Failed to compile protocol. Got error: %s", err)
+	}
+	// Each step moves above and into the well, actuates the plunger, then retracts
+	if len(commands) != 12 {
+		t.Fatalf("Should have compiled 12 commands. Got %d", len(commands))
+	}
+	aspirate := commands[2]
+	if aspirate.Command != "aspirate" || aspirate.Volume != 100 || aspirate.FlowRate != DefaultFlowRate || aspirate.Target != "deck/1/nest_96_wellplate_100ul_pcr_full_skirt/A1" {
+		t.Errorf("Aspirate should use the default flow rate on A1. Got %+v", aspirate)
+	}
+	if commands[1].Pose.Position.Z >= commands[0].Pose.Position.Z {
+		t.Errorf("Aspirate should happen inside the well")
+	}
+
+	run := runProtocol(t, pipette, protocol)
+	if run.Status != RunCompleted {
+		t.Errorf("Run should have COMPLETED. Got: %s %v", run.Status, run.StatusMessage)
+	}
+	if pipette.Volume() != 0 {
+		t.Errorf("Pipette should be empty after dispensing everything. Got %gµL", pipette.Volume())
+	}
+
+	// Volumes the pipette cannot hold should fail to compile
+	for _, badProtocol := range [][]CommandInput{
+		{CommandAspirate{Placement: plate, Address: "A1", Volume: 301}},
+		{CommandDispense{Placement: plate, Address: "A1", Volume: 1}},
+		{CommandAspirate{Placement: plate, Address: "A1", Volume: -1}},
+	} {
+		_, err = SimulateProtocol(db, pipette, badProtocol, OptimizeOptions{})
+		if err == nil || !strings.HasPrefix(err.Error(), "step 0: ") {
+			t.Errorf("Protocol %+v should fail on step 0. Got: %v", badProtocol, err)
+		}
+	}
+}
+
+func TestWellOrder(t *testing.T) {
+	wells := wellOrder([]Well{{Address: "A2"}, {Address: "B10"}, {Address: "B1"}, {Address: "A10"}, {Address: "A1"}})
+	var addresses []string
+	for _, well := range wells {
+		addresses = append(addresses, well.Address)
+	}
+	if strings.Join(addresses, ",") != "A1,B1,A2,A10,B10" {
+		t.Errorf("Wells should be ordered column by column. Got: %v", addresses)
+	}
+}
+
+func TestExpandWells(t *testing.T) {
+	wells, err := expandWells([]string{"A1:C2", "H12"})
+	if err != nil {
+		t.Fatalf("Failed to expandWells. Got error: %s", err)
+	}
+	if strings.Join(wells, ",") != "A1,B1,C1,A2,B2,C2,H12" {
+		t.Errorf("Ranges should expand column by column. Got: %v", wells)
+	}
+	for _, bad := range []string{"A1:", "C1:A1", "A2:A1", "A1:B1:C1"} {
+		_, err = expandWells([]string{bad})
+		if err == nil {
+			t.Errorf("Range %s should fail to expand", bad)
+		}
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	plate := Placement{Deck: "deck", Location: "1", LabwareName: "nest_96_wellplate_100ul_pcr_full_skirt"}
+	tipRack := Placement{Deck: "deck", Location: "1", LabwareName: "opentrons_96_tiprack_300ul"}
+	transfer := CommandTransfer{Source: plate, SourceWells: []string{"A1"}, Destination: plate, DestinationWells: []string{"B1:D1"}, Volumes: []float64{400}, TipRack: tipRack, Trash: tipRack}
+
+	// Count the commands each tip option expands to
+	pipette := ConnectMockPipette(300)
+	for newTip, expected := range map[string]string{
+		"":           "pick_up_tip aspirate dispense aspirate dispense aspirate dispense aspirate dispense aspirate dispense aspirate dispense drop_tip",
+		NewTipAlways: "pick_up_tip aspirate dispense aspirate dispense drop_tip pick_up_tip aspirate dispense aspirate dispense drop_tip pick_up_tip aspirate dispense aspirate dispense drop_tip",
+		NewTipNever:  "aspirate dispense aspirate dispense aspirate dispense aspirate dispense aspirate dispense aspirate dispense",
+	} {
+		transfer.NewTip = newTip
+		steps, err := transfer.Expand(pipette)
+		if err != nil {
+			t.Fatalf("Failed to Expand. Got error: %s", err)
+		}
+		var names []string
+		for _, step := range steps {
+			names = append(names, step.Command())
+		}
+		if strings.Join(names, " ") != expected {
+			t.Errorf("Transfer with new_tip %q expanded to: %v", newTip, names)
+		}
+	}
+	// Volumes are split evenly into trips the pipette can hold
+	transfer.NewTip = NewTipNever
+	steps, _ := transfer.Expand(pipette)
+	if steps[0].(CommandAspirate).Volume != 200 || steps[0].(CommandAspirate).Address != "A1" || steps[1].(CommandDispense).Address != "B1" {
+		t.Errorf("First trip should move 200µL from A1 to B1. Got: %+v %+v", steps[0], steps[1])
+	}
+
+	// Transfers compile as a single step
+	transfer.NewTip = NewTipAlways
+	commands, err := SimulateProtocol(db, pipette, []CommandInput{CommandXyz{X: 257, Y: 0, Z: 307, Qx: 0.7071067811865476, Qz: -0.7071067811865476}, transfer}, OptimizeOptions{})
+	if err != nil {
+		t.Fatalf("Failed to SimulateProtocol. Got error: %s", err)
+	}
+	tips := map[string]bool{}
+	for _, command := range commands[1:] {
+		if command.Step != 1 {
+			t.Errorf("Transfer commands should all be step 1. Got: %+v", command)
+		}
+		if command.Tip != nil {
+			tips[command.Tip.Address] = true
+		}
+	}
+	if len(tips) != 3 {
+		t.Errorf("Transfer should use 3 different tips. Got: %v", tips)
+	}
+
+	// Sources and destinations must pair up
+	transfer.SourceWells = []string{"A1", "A2"}
+	_, err = SimulateProtocol(db, pipette, []CommandInput{transfer}, OptimizeOptions{})
+	if err == nil || !strings.HasPrefix(err.Error(), "step 0: ") {
+		t.Errorf("Unpaired transfer should fail on step 0. Got: %v", err)
+	}
+}
+
+func TestDistributeConsolidate(t *testing.T) {
+	plate := Placement{Deck: "deck", Location: "1", LabwareName: "nest_96_wellplate_100ul_pcr_full_skirt"}
+	tipRack := Placement{Deck: "deck", Location: "1", LabwareName: "opentrons_96_tiprack_300ul"}
+	pipette := ConnectMockPipette(300)
+
+	// 8 dispenses of 60µL with 20µL disposal fit 4 per trip
+	distribute := CommandDistribute{Source: plate, SourceWell: "A1", Destination: plate, DestinationWells: []string{"A2:H2"}, Volumes: []float64{60}, DisposalVolume: 20, TipRack: tipRack, Trash: tipRack}
+	steps, err := distribute.Expand(pipette)
+	if err != nil {
+		t.Fatalf("Failed to Expand distribute. Got error: %s", err)
+	}
+	var aspirates []float64
+	dispenses := 0
+	for _, step := range steps {
+		switch step := step.(type) {
+		case CommandAspirate:
+			aspirates = append(aspirates, step.Volume)
+		case CommandDispense:
+			dispenses++
+		}
+	}
+	if len(aspirates) != 2 || aspirates[0] != 260 || aspirates[1] != 260 {
+		t.Errorf("Distribute should aspirate 260µL twice. Got: %v", aspirates)
+	}
+	if dispenses != 10 {
+		t.Errorf("Distribute should dispense 8 wells and 2 disposals. Got: %d", dispenses)
+	}
+	_, err = SimulateProtocol(db, pipette, []CommandInput{distribute}, OptimizeOptions{})
+	if err != nil {
+		t.Errorf("Failed to SimulateProtocol distribute. Got error: %s", err)
+	}
+	distribute.DisposalVolume = 250
+	_, err = distribute.Expand(pipette)
+	if err == nil {
+		t.Errorf("Distribute with too much disposal volume should fail")
+	}
+
+	// 5 sources of 100µL pool in 2 trips
+	consolidate := CommandConsolidate{Source: plate, SourceWells: []string{"A3:E3"}, Destination: plate, DestinationWell: "A1", Volumes: []float64{100}, NewTip: NewTipAlways, TipRack: tipRack, Trash: tipRack}
+	steps, err = consolidate.Expand(pipette)
+	if err != nil {
+		t.Fatalf("Failed to Expand consolidate. Got error: %s", err)
+	}
+	var names []string
+	for _, step := range steps {
+		names = append(names, step.Command())
+	}
+	if strings.Join(names, " ") != "pick_up_tip aspirate aspirate aspirate dispense drop_tip pick_up_tip aspirate aspirate dispense drop_tip" {
+		t.Errorf("Consolidate expanded to: %v", names)
+	}
+	_, err = SimulateProtocol(db, pipette, []CommandInput{consolidate}, OptimizeOptions{})
+	if err != nil {
+		t.Errorf("Failed to SimulateProtocol consolidate. Got error: %s", err)
+	}
+}
+
+func TestLiquidHandlingPrimitives(t *testing.T) {
+	plate := Placement{Deck: "deck", Location: "1", LabwareName: "nest_96_wellplate_100ul_pcr_full_skirt"}
+	pipette := ConnectMockPipette(300)
+	_ = pipette.PickUpTip()
+	protocol := []CommandInput{
+		CommandAspirate{Placement: plate, Address: "A1", Volume: 50, DepthFromBottom: 1},
+		CommandAirGap{Volume: 10},
+		CommandDispense{Placement: plate, Address: "B1", Volume: 50, DepthFromBottom: 1},
+		CommandMix{Placement: plate, Address: "B1", Volume: 20, Repetitions: 3, DepthFromBottom: 1},
+		CommandTouchTip{Placement: plate, Address: "B1", Radius: 0.5},
+		CommandBlowOut{Placement: plate, Address: "B1"},
+	}
+	tx := db.MustBegin()
+	commands, err := compileProtocol(tx, pipette, protocol, pipette.HasTip(), pipette.Volume())
+	_ = tx.Rollback()
+	if err != nil {
+		t.Fatalf("Failed to compile protocol. Got error: %s", err)
+	}
+	steps := make(map[int][]Command)
+	for _, command := range commands {
+		steps[command.Step] = append(steps[command.Step], command)
+	}
+	if steps[1][0].Command != "air_gap" || steps[1][0].Volume != 10 {
+		t.Errorf("Air gap should aspirate 10µL. Got: %+v", steps[1])
+	}
+	plunger := 0
+	for _, command := range steps[3] {
+		if command.Command == "aspirate" || command.Command == "dispense" {
+			plunger++
+		}
+	}
+	if plunger != 6 {
+		t.Errorf("Mix should aspirate and dispense 3 times. Got %d plunger commands", plunger)
+	}
+
+	// Touch tip reaches half the radius out from the well center, 1mm below the top
+	touch := steps[4]
+	if len(touch) != 8 {
+		t.Fatalf("Touch tip should compile to 8 moves. Got %d", len(touch))
+	}
+	center := touch[1].Pose.Position
+	var well Well
+	tx = db.MustBegin()
+	labware, _ := GetLabware(tx, plate.LabwareName)
+	_ = tx.Rollback()
+	for _, w := range labware.Wells {
+		if w.Address == "B1" {
+			well = w
+		}
+	}
+	offset := math.Hypot(touch[2].Pose.Position.X-center.X, touch[2].Pose.Position.Y-center.Y)
+	if math.Abs(offset-well.Diameter/4) > 1e-9 {
+		t.Errorf("Touch tip should move %gmm from the center. Got %gmm", well.Diameter/4, offset)
+	}
+	if math.Abs(center.Z-(steps[2][1].Pose.Position.Z-1+well.Depth-1)) > 1e-9 {
+		t.Errorf("Touch tip should be 1mm below the top of the well. Got Z %g", center.Z)
+	}
+	if steps[5][2].Command != "blow_out" {
+		t.Errorf("Blow out should blow out at the top of the well. Got: %+v", steps[5])
+	}
+
+	run := runProtocol(t, pipette, protocol)
+	if run.Status != RunCompleted {
+		t.Errorf("Run should have COMPLETED. Got: %s %v", run.Status, run.StatusMessage)
+	}
+	if pipette.Volume() != 0 {
+		t.Errorf("Pipette should be empty after blowing out. Got %gµL", pipette.Volume())
+	}
+
+	// Liquid is only handled with a tip on the pipette
+	for _, step := range protocol {
+		_, err = SimulateProtocol(db, ConnectMockPipette(300), []CommandInput{step}, OptimizeOptions{})
+		if err == nil || !strings.Contains(err.Error(), "Pipette has no tip") {
+			t.Errorf("%s without a tip should fail. Got error: %v", step.Command(), err)
+		}
+	}
+}
+
+func TestOptimizeCommands(t *testing.T) {
+	plate := Placement{Deck: "travelDeck", Location: "1", LabwareName: "nest_96_wellplate_100ul_pcr_full_skirt"}
+	tipRack := Placement{Deck: "travelDeck", Location: "2", LabwareName: "opentrons_96_tiprack_300ul"}
+	tx := db.MustBegin()
+	defer func() { _ = tx.Rollback() }()
+	err := CreateDeck(tx, InputDeck{Name: "travelDeck", TravelHeight: 100, Locations: []Location{{Name: "1", X: 1, Y: 1, Z: 1}, {Name: "2", X: 100, Y: 1, Z: 1}}})
+	if err != nil {
+		t.Fatalf("Failed to CreateDeck. Got error: %s", err)
+	}
+	err = SetDeckCalibration(tx, "travelDeck", 257, 0, 307, 0, 0.7071067811865476, 0, -0.7071067811865476)
+	if err != nil {
+		t.Fatalf("Failed to SetDeckCalibration. Got error: %s", err)
+	}
+	// Protocols compile with a tip already on the pipette, unless they pick
+	// one up themselves
+	compile := func(protocol []CommandInput, options OptimizeOptions) []Command {
+		hasTip := len(protocol) > 0 && protocol[0].Command() == "aspirate"
+		commands, err := compileProtocol(tx, ConnectMockPipette(300), protocol, hasTip, 0)
+		if err != nil {
+			t.Fatalf("Failed to CompileProtocol. Got error: %s", err)
+		}
+		return OptimizeCommands(commands, options)
+	}
+	moves := func(commands []Command) []Command {
+		var moves []Command
+		for _, command := range commands {
+			if command.Command == "move" {
+				moves = append(moves, command)
+			}
+		}
+		return moves
+	}
+
+	// Mixing after a dispense stays in the well
+	protocol := []CommandInput{
+		CommandAspirate{Placement: plate, Address: "A1", Volume: 10, DepthFromBottom: 1},
+		CommandDispense{Placement: plate, Address: "A2", Volume: 10, DepthFromBottom: 1},
+		CommandMix{Placement: plate, Address: "A2", Volume: 10, Repetitions: 1, DepthFromBottom: 1},
+	}
+	optimized := compile(protocol, DefaultOptimizeOptions)
+	for i, command := range optimized {
+		if command.Command == "dispense" {
+			if optimized[i+1].Command != "aspirate" {
+				t.Errorf("Mix should follow the dispense without moving. Got: %+v", optimized[i+1])
+			}
+			break
+		}
+	}
+	if len(moves(optimized)) != 6 || len(moves(compile(protocol, OptimizeOptions{}))) != 9 {
+		t.Errorf("Optimizing should drop 3 moves. Got %d moves", len(moves(optimized)))
+	}
+
+	// Moving between wells of a labware stays just above them
+	unoptimized := compile(protocol[:2], OptimizeOptions{})
+	optimized = compile(protocol[:2], DefaultOptimizeOptions)
+	lowered := moves(optimized)[2]
+	if lowered.Pose.Position.Z >= moves(unoptimized)[2].Pose.Position.Z || lowered.Pose.Position.Z < moves(unoptimized)[1].Pose.Position.Z {
+		t.Errorf("Retract between wells should be lowered above the wells. Got Z %g", lowered.Pose.Position.Z)
+	}
+
+	// Moving between labwares goes up to the travel height of the deck
+	optimized = compile([]CommandInput{CommandPickUpTip{Placement: tipRack}, protocol[0]}, DefaultOptimizeOptions)
+	traveled := 0
+	for _, move := range moves(optimized) {
+		if move.Pose.Position.Z == 407 {
+			traveled++
+		}
+	}
+	if traveled != 2 {
+		t.Errorf("Arm should travel between labwares at Z 407. Got %d moves at travel height", traveled)
+	}
+
+	// Independent hit picks are reordered to the nearest next pick
+	pick := CommandTransfer{Source: plate, SourceWells: []string{"A1", "H1", "B1"}, Destination: plate, DestinationWells: []string{"A12", "H12", "B12"}, Volumes: []float64{10}, NewTip: NewTipAlways, TipRack: tipRack, Trash: tipRack}
+	var order []string
+	for _, command := range compile([]CommandInput{pick}, OptimizeOptions{Reorder: true}) {
+		if command.Command == "aspirate" {
+			order = append(order, command.Target[strings.LastIndex(command.Target, "/")+1:])
+		}
+	}
+	if strings.Join(order, ",") != "A1,B1,H1" {
+		t.Errorf("Picks should be reordered to A1,B1,H1. Got: %v", order)
+	}
+	// Picks sharing wells are not reordered
+	pick.DestinationWells = []string{"A12", "H12", "A12"}
+	order = nil
+	for _, command := range compile([]CommandInput{pick}, OptimizeOptions{Reorder: true}) {
+		if command.Command == "aspirate" {
+			order = append(order, command.Target[strings.LastIndex(command.Target, "/")+1:])
+		}
+	}
+	if strings.Join(order, ",") != "A1,H1,B1" {
+		t.Errorf("Dependent picks should keep their order. Got: %v", order)
+	}
+}
+
+func TestPipetteMock(t *testing.T) {
+	pipette := ConnectMockPipette(20)
+	err := pipette.Aspirate(15, 10)
+	if err != nil {
+		t.Errorf("Failed to Aspirate. Got error: %s", err)
+	}
+	err = pipette.Aspirate(10, 10)
+	if err == nil {
+		t.Errorf("Aspirate should fail past max volume")
+	}
+	err = pipette.Dispense(20, 10)
+	if err == nil {
+		t.Errorf("Dispense should fail past held volume")
+	}
+	err = pipette.Dispense(15, 10)
+	if err != nil {
+		t.Errorf("Failed to Dispense. Got error: %s", err)
+	}
+	if pipette.Volume() != 0 {
+		t.Errorf("Pipette should be empty. Got %gµL", pipette.Volume())
+	}
+}
+
+func TestDecodeProtocol(t *testing.T) {
+	protocol := []CommandInput{
+		CommandXyz{X: 257, Y: 0, Z: 307, Qx: 0.7071067811865476, Qz: -0.7071067811865476},
+		CommandMove{Deck: "deck", Location: "1", LabwareName: "nest_96_wellplate_100ul_pcr_full_skirt", Address: "A1", DepthFromBottom: 1},
+	}
+	encoded, err := EncodeProtocol(protocol)
+	if err != nil {
+		t.Errorf("Failed to EncodeProtocol: %s", err)
+	}
+	decoded, err := DecodeProtocol(encoded)
+	if err != nil {
+		t.Errorf("Failed to DecodeProtocol: %s", err)
+	}
+	if len(decoded) != 2 {
+		t.Fatalf("Should have decoded 2 steps. Got %d", len(decoded))
+	}
+	if decoded[0] != protocol[0] || decoded[1] != protocol[1] {
+		t.Errorf("Decoded protocol should match encoded protocol. Got: %v", decoded)
+	}
+
+	// Bad steps should fail and name their index
+	for _, badProtocol := range []string{
+		`[{"command": "movexyz"}, {"x": 1}]`,
+		`[{"command": "movexyz"}, {"command": "fly"}]`,
+		`[{"command": "movexyz"}, {"command": "movexyz", "w": 1}]`,
+		`[{"command": "movexyz"}, 4]`,
+	} {
+		_, err = DecodeProtocol([]byte(badProtocol))
+		if err == nil || !strings.HasPrefix(err.Error(), "step 1:") {
+			t.Errorf("Decoding %s should fail on step 1. Got: %v", badProtocol, err)
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	tx := db.MustBegin()
+	id, err := CreateRun(tx, []byte(`[]`))
 	if err != nil {
-		t.Errorf("Failed to ExecuteProtocol: %s", err)
+		t.Errorf("Failed to CreateRun: %s", err)
+	}
+	run, err := GetRun(tx, id)
+	if err != nil {
+		t.Errorf("Failed to GetRun: %s", err)
+	}
+	if run.Status != RunRunning || run.End != nil {
+		t.Errorf("New run should be RUNNING without an end. Got: %s", run.Status)
+	}
+
+	err = FinishRun(tx, id, RunFailed, "arm unplugged")
+	if err != nil {
+		t.Errorf("Failed to FinishRun: %s", err)
+	}
+	run, err = GetRun(tx, id)
+	if err != nil {
+		t.Errorf("Failed to GetRun after finishing: %s", err)
+	}
+	if run.Status != RunFailed || run.StatusMessage == nil || *run.StatusMessage != "arm unplugged" {
+		t.Errorf("Run should have FAILED with a status message. Got: %s", run.Status)
+	}
+	if run.End == nil {
+		t.Errorf("Finished run should have an end time")
+	}
+
+	err = tx.Rollback()
+	if err != nil {
+		t.Errorf("Rollback should succeed")
+	}
+}
+
+func TestEstimateProtocol(t *testing.T) {
+	commands := []Command{
+		{Command: "move", Pose: kinematics.Pose{Position: kinematics.Position{X: 100}}, Step: 0},
+		{Command: "move", Pose: kinematics.Pose{Position: kinematics.Position{X: 100, Z: 50}}, Step: 1},
+		{Command: "wait", WaitTime: 500, Step: 1},
+	}
+	estimate := EstimateProtocol(commands, kinematics.Pose{})
+
+	// 100mm at 50mm/s, with 20% of the move ramping at an average of 55%
+	// of full speed
+	if estimate.Steps[0].Duration != 2327 {
+		t.Errorf("Step 0 should take 2327ms. Got: %d", estimate.Steps[0].Duration)
+	}
+	if estimate.Steps[1].Duration != 1664 {
+		t.Errorf("Step 1 should take 1664ms. Got: %d", estimate.Steps[1].Duration)
+	}
+	if estimate.Duration != 3991 {
+		t.Errorf("Protocol should take 3991ms. Got: %d", estimate.Duration)
+	}
+}
+
+func TestCheckReachability(t *testing.T) {
+	rotation := kinematics.Quaternion{W: 0, X: 0.7071067811865476, Y: 0, Z: -0.7071067811865476}
+	commands := []Command{
+		{Command: "move", Pose: kinematics.Pose{Position: kinematics.Position{X: 257, Y: 0, Z: 287}, Rotation: rotation}, Step: 0},
+		{Command: "move", Pose: kinematics.Pose{Position: kinematics.Position{X: 132, Y: 158, Z: 121}, Rotation: rotation}, Step: 1, Target: "deck/1/plate/A1"},
+		{Command: "move", Pose: kinematics.Pose{Position: kinematics.Position{X: 257, Y: 0, Z: 307}, Rotation: rotation}, Step: 2},
+	}
+	err := CheckReachability(commands[:1], readyJoints)
+	if err != nil {
+		t.Errorf("Reachable commands should pass. Got: %s", err)
+	}
+
+	err = CheckReachability(commands, readyJoints)
+	unreachableErr, ok := err.(UnreachableError)
+	if !ok {
+		t.Fatalf("Commands should be unreachable. Got: %v", err)
+	}
+	if len(unreachableErr.Commands) != 1 || unreachableErr.Commands[0].Index != 1 {
+		t.Errorf("Only command 1 should be unreachable. Got: %+v", unreachableErr.Commands)
+	}
+	if !strings.Contains(err.Error(), "step 1, command 1 (deck/1/plate/A1): J2 out of range") {
+		t.Errorf("Error should name the step and its target well. Got: %s", err)
+	}
+}
+
+// schemaV0 is the Schema from before the schema was versioned.
+const schemaV0 = `
+CREATE TABLE labware (name TEXT PRIMARY KEY, zdimension REAL NOT NULL);
+CREATE TABLE well (
+	labware TEXT NOT NULL REFERENCES labware(name) ON DELETE CASCADE,
+	address TEXT NOT NULL, depth REAL NOT NULL, diameter REAL NOT NULL,
+	x REAL NOT NULL, y REAL NOT NULL, z REAL NOT NULL
+);
+CREATE TABLE deck (
+	name TEXT PRIMARY KEY, calibrated BOOLEAN DEFAULT false,
+	x REAL NOT NULL DEFAULT 0, y REAL NOT NULL DEFAULT 0, z REAL NOT NULL DEFAULT 0,
+	qw REAL NOT NULL DEFAULT 0, qx REAL NOT NULL DEFAULT 0, qy REAL NOT NULL DEFAULT 0, qz REAL NOT NULL DEFAULT 0
+);
+CREATE TABLE activity_log (
+	id INTEGER PRIMARY KEY AUTOINCREMENT, start INTEGER NOT NULL, end INTEGER, program TEXT NOT NULL,
+	status TEXT NOT NULL CHECK (status IN ('RUNNING', 'FAILED', 'COMPLETED')), status_message TEXT
+);
+INSERT INTO labware VALUES ('old_plate', 10);
+INSERT INTO well VALUES ('old_plate', 'A1', 5, 5, 5, 5, 1);
+INSERT INTO labware VALUES ('agilent_1_reservoir_290ml', 39.22);
+INSERT INTO well VALUES ('agilent_1_reservoir_290ml', 'A1', 39.22, 0, 63.88, 42.74, 0);
+INSERT INTO deck(name) VALUES ('old_deck');
+INSERT INTO activity_log(start, program, status) VALUES (1, X'5B5D', 'COMPLETED');
+`
+
+func TestMigrateDatabase(t *testing.T) {
+	old, err := sqlx.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatalf("Failed to open database. Got error: %s", err)
+	}
+	defer old.Close()
+	old.SetMaxOpenConns(1)
+	old.MustExec(schemaV0)
+
+	// Migrating twice leaves the database as migrated once
+	for i := 0; i < 2; i++ {
+		err = CreateDatabase(old)
+		if err != nil {
+			t.Fatalf("Failed to migrate database. Got error: %s", err)
+		}
+	}
+	var version int
+	_ = old.Get(&version, "PRAGMA user_version")
+	if version != schemaVersion {
+		t.Errorf("Database should be at version %d. Got: %d", schemaVersion, version)
+	}
+
+	tx := old.MustBegin()
+	defer func() { _ = tx.Rollback() }()
+	labware, err := GetLabware(tx, "old_plate")
+	if err != nil || labware.Version != 1 || len(labware.Wells) != 1 || labware.Wells[0].Shape != "circular" {
+		t.Errorf("Labware should be migrated to version 1. Got: %+v, error: %v", labware, err)
+	}
+	_, err = GetLabware(tx, "opentrons_96_tiprack_300ul")
+	if err != nil {
+		t.Errorf("Default labware should be added. Got error: %s", err)
+	}
+	migrated, _ := GetLabware(tx, "agilent_1_reservoir_290ml")
+	freshTx := db.MustBegin()
+	fresh, _ := GetLabware(freshTx, "agilent_1_reservoir_290ml")
+	_ = freshTx.Rollback()
+	if !reflect.DeepEqual(migrated, fresh) {
+		t.Errorf("Default labware should be replaced.\nGot:  %+v\nWant: %+v", migrated, fresh)
+	}
+	deck, err := GetDeck(tx, "old_deck")
+	if err != nil || deck.TravelHeight != 0 {
+		t.Errorf("Deck should have a travel height. Got: %+v, error: %v", deck, err)
+	}
+	err = SetRunStatus(tx, 1, RunPaused, "")
+	if err != nil {
+		t.Errorf("Runs should take the new statuses. Got error: %s", err)
+	}
+	run, err := GetRun(tx, 1)
+	if err != nil || run.Status != RunPaused || len(run.Labwares) != 0 || len(run.Placements) != 0 {
+		t.Errorf("Run should be migrated. Got: %+v, error: %v", run, err)
+	}
+}
+
+func TestFailUnfinishedRuns(t *testing.T) {
+	restarted, err := sqlx.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatalf("Failed to open database. Got error: %s", err)
+	}
+	defer restarted.Close()
+	restarted.SetMaxOpenConns(1)
+	err = CreateDatabase(restarted)
+	if err != nil {
+		t.Fatalf("Failed to create database. Got error: %s", err)
+	}
+	tx := restarted.MustBegin()
+	running, _ := CreateRun(tx, []byte(`[]`))
+	paused, _ := CreateRun(tx, []byte(`[]`))
+	_ = SetRunStatus(tx, paused, RunPaused, "")
+	completed, _ := CreateRun(tx, []byte(`[]`))
+	_ = FinishRun(tx, completed, RunCompleted, "")
+	_ = tx.Commit()
+
+	// Starting on the same database fails the runs nothing executes anymore
+	err = CreateDatabase(restarted)
+	if err != nil {
+		t.Fatalf("Failed to create database. Got error: %s", err)
+	}
+	tx = restarted.MustBegin()
+	defer func() { _ = tx.Rollback() }()
+	for _, id := range []int64{running, paused} {
+		run, _ := GetRun(tx, id)
+		if run.Status != RunFailed || run.End == nil || run.StatusMessage == nil || *run.StatusMessage != "Server restarted" {
+			t.Errorf("Run %d should have FAILED. Got: %+v", id, run)
+		}
+		events, _ := GetRunEvents(tx, id, 0)
+		if len(events) != 1 || events[0].Status != RunFailed {
+			t.Errorf("Run %d should have a FAILED event. Got: %+v", id, events)
+		}
+	}
+	run, _ := GetRun(tx, completed)
+	if run.Status != RunCompleted {
+		t.Errorf("Finished run should be unchanged. Got: %+v", run)
 	}
 }